@@ -1,7 +1,9 @@
 module main
 
 require (
+	github.com/gorilla/websocket v1.5.1
 	github.com/sourcegraph/jsonrpc2 v0.2.0
+	github.com/spf13/cobra v1.8.0
 	github.com/tliron/commonlog v0.2.15
 	github.com/tliron/glsp v0.2.2
 )
@@ -12,7 +14,6 @@ replace github.com/sourcegraph/jsonrpc2 v0.2.0 => ./jsonrpc2
 
 require (
 	github.com/aymanbagabas/go-osc52/v2 v2.0.1 // indirect
-	github.com/gorilla/websocket v1.5.1 // indirect
 	github.com/iancoleman/strcase v0.3.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
@@ -24,7 +25,6 @@ require (
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/sasha-s/go-deadlock v0.3.1 // indirect
 	github.com/segmentio/ksuid v1.0.4 // indirect
-	github.com/spf13/cobra v1.8.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/tliron/kutil v0.3.18 // indirect
 	golang.org/x/crypto v0.21.0 // indirect
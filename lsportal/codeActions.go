@@ -0,0 +1,106 @@
+package lsportal
+
+// Code actions are asked for a range rather than a position, which is cut down to the inclusions like any range
+// request, see rangeRequests.go. Code actions for host code and its diagnostics are the host server's business.
+// The edits of the code actions that come back go through the same checks as a rename, an action that would edit
+// outside the inclusions is dropped rather than failing the whole list.
+// Like inlay hints, the code actions we hand out remember their document and route for codeAction/resolve, see
+// inlayHints.go.
+
+import (
+	"github.com/tliron/glsp"
+)
+
+// Drops the diagnostics of host code from codeAction params, the client sends every diagnostic in the range
+func filterCodeActionDiagnostics(params map[string]any, doc *TextDocument) {
+	actionContext, ok := params["context"].(map[string]any)
+	if !ok {
+		return
+	}
+	diagnostics, _ := actionContext["diagnostics"].([]any)
+	kept := []any{}
+	for _, diagnostic := range diagnostics {
+		diagnostic, _ := diagnostic.(map[string]any)
+		if r, ok := asRange(diagnostic["range"]); ok && doc.inclusionOf(r) >= 0 {
+			kept = append(kept, diagnostic)
+		}
+	}
+	actionContext["diagnostics"] = kept
+}
+
+// Moves the code actions, or commands, of a codeAction response into the host document
+func (trans *FromClientTransformer) transformCodeActions(context *glsp.Context, response *any) {
+	actions, ok := (*response).([]any)
+	if !ok {
+		*response = nil
+		return
+	}
+	kept := []any{}
+	for _, action := range actions {
+		if action, ok := trans.transformCodeAction(context, action); ok {
+			kept = append(kept, action)
+		}
+	}
+	*response = kept
+}
+
+// Moves a code action into the host document, false if it has to be dropped
+func (trans *FromClientTransformer) transformCodeAction(context *glsp.Context, action any) (any, bool) {
+	object, ok := action.(map[string]any)
+	if !ok {
+		return action, false
+	}
+	// The edit names its own documents, walking it with the rest would move its edits across the wrong source map
+	edit, hasEdit := object["edit"]
+	delete(object, "edit")
+	// An echo of the document we named when resolving
+	delete(object, "textDocument")
+	moved, ok := trans.toHost().walk(object, trans.toHost().requestSourceMap(context))
+	if !ok {
+		return action, false
+	}
+	if hasEdit {
+		if err := trans.confineWorkspaceEdit(edit); err != nil {
+			title, _ := object["title"].(string)
+			trans.logger.Infof("Dropping code action %q: %v", title, err)
+			return action, false
+		}
+		object["edit"] = edit
+	}
+	// Commands can't be resolved, only code actions
+	if _, isCommand := object["command"].(string); !isCommand {
+		trans.tag(object, trans.UriMap[requestUri(context)])
+	}
+	return moved, true
+}
+
+// Puts back the data of the inner server in the code action of a codeAction/resolve request and moves it into the
+// virtual document, which is named in a textDocument field the inner server ignores
+func (trans *FromClientTransformer) unwrapCodeAction(context *glsp.Context) error {
+	return runParamsTransform(context, func(params *map[string]any) error {
+		uri, ok := untag(*params)
+		if !ok {
+			return reject("Can't resolve a code action lsportal didn't hand out")
+		}
+		doc, ok := trans.Documents[uri]
+		if !ok {
+			return reject("Can't resolve a code action of %s, it was closed", uri)
+		}
+		// An edit we handed out is in the host already, the inner server resolves the action to its own edit
+		delete(*params, "edit")
+		if diagnostics, ok := (*params)["diagnostics"].([]any); ok {
+			kept := []any{}
+			for _, diagnostic := range diagnostics {
+				diagnostic, _ := diagnostic.(map[string]any)
+				if r, ok := asRange(diagnostic["range"]); ok && doc.inclusionOf(r) >= 0 {
+					kept = append(kept, diagnostic)
+				}
+			}
+			(*params)["diagnostics"] = kept
+		}
+		moved, _ := trans.toVirtual().walk(*params, &doc.SourceMap)
+		*params = moved.(map[string]any)
+		(*params)["textDocument"] = map[string]any{"uri": trans.changeExtension(uri)}
+		return nil
+	})
+}
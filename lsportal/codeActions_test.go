@@ -0,0 +1,129 @@
+package lsportal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestCodeActionRequest(t *testing.T) {
+	diagnostics := `[{"range": {"start": {"line": 0, "character": 0}, "end": {"line": 0, "character": 1}}, "message": "go"}, {"range": {"start": {"line": 1, "character": 13}, "end": {"line": 1, "character": 14}}, "message": "html"}]`
+	tests := []struct {
+		name     string
+		r        string
+		expected string
+	}{
+		{"range is cut down to the inclusion", `{"start": {"line": 0, "character": 0}, "end": {"line": 1, "character": 30}}`, `{"end":{"character":16,"line":1},"start":{"character":12,"line":1}}`},
+		{"range within the inclusion stays", `{"start": {"line": 1, "character": 13}, "end": {"line": 1, "character": 14}}`, `{"end":{"character":14,"line":1},"start":{"character":13,"line":1}}`},
+		{"range outside the inclusions is answered right away", `{"start": {"line": 0, "character": 0}, "end": {"line": 0, "character": 3}}`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trans := NewFromClientTransformer("htmlT\\(`([\\s\\S]*?)`\\)", "", "html")
+			trans.TransformRequest(&glsp.Context{
+				Method: protocol.MethodTextDocumentDidOpen,
+				Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x := 1\na := htmlT(` + "`" + `<b/>` + "`" + `)"}}`),
+			})
+			context := &glsp.Context{
+				Method: protocol.MethodTextDocumentCodeAction,
+				Params: []byte(`{"textDocument": {"uri": "file:///a.go"}, "range": ` + test.r + `, "context": {"diagnostics": ` + diagnostics + `}}`),
+			}
+			err := trans.TransformRequest(context)
+			if test.expected == "" {
+				var rejected *rejectedError
+				if !errors.As(err, &rejected) || rejected.result == nil {
+					t.Errorf("Expected the request to be answered with no actions, Got: %v", err)
+				}
+				return
+			}
+			var params struct {
+				Range   json.RawMessage `json:"range"`
+				Context struct {
+					Diagnostics []protocol.Diagnostic `json:"diagnostics"`
+				} `json:"context"`
+			}
+			if err != nil || json.Unmarshal(context.Params, &params) != nil {
+				t.Fatalf("Failed to transform: %v, %s", err, context.Params)
+			}
+			if string(params.Range) != test.expected {
+				t.Errorf("Expected: %s, Got: %s", test.expected, params.Range)
+			}
+			if len(params.Context.Diagnostics) != 1 || params.Context.Diagnostics[0].Message != "html" {
+				t.Errorf("Expected only the diagnostics of the inclusion, Got: %v", params.Context.Diagnostics)
+			}
+		})
+	}
+}
+
+func TestCodeActionResponse(t *testing.T) {
+	trans := NewFromClientTransformer("htmlT\\(`([\\s\\S]*?)`\\)", "", "html")
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x := 1\na := htmlT(` + "`" + `<b/>` + "`" + `)"}}`),
+	})
+	edit := func(line int) string {
+		return fmt.Sprintf(`{"changes": {"file:///a.html": [{"range": {"start": {"line": %d, "character": 13}, "end": {"line": %d, "character": 14}}, "newText": "i"}]}}`, line, line)
+	}
+	var response any
+	json.Unmarshal([]byte(`[
+		{"title": "inside", "edit": `+edit(1)+`},
+		{"title": "outside", "edit": `+edit(0)+`},
+		{"title": "command", "command": "open", "arguments": [{"uri": "file:///a.html"}]}
+	]`), &response)
+	context := &glsp.Context{Method: protocol.MethodTextDocumentCodeAction, Params: []byte(`{"textDocument": {"uri": "file:///a.html"}}`)}
+	if err := trans.TransformResponse(context, &response); err != nil {
+		t.Fatalf("Failed to transform: %v", err)
+	}
+	got, _ := json.Marshal(response)
+	expected := `[{"data":{"lsportalRoute":"","lsportalUri":"file:///a.go"},"edit":{"changes":{"file:///a.go":[{"newText":"i","range":{"start":{"line":1,"character":13},"end":{"line":1,"character":14}}}]}},"title":"inside"},` +
+		`{"arguments":[{"uri":"file:///a.go"}],"command":"open","title":"command"}]`
+	if string(got) != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, got)
+	}
+
+	var resolved any
+	json.Unmarshal([]byte(`{"title": "outside", "edit": `+edit(0)+`}`), &resolved)
+	if err := trans.TransformResponse(&glsp.Context{Method: protocol.MethodCodeActionResolve, Params: []byte(`{"title": "outside"}`)}, &resolved); err == nil {
+		t.Errorf("Expected resolving to an edit outside of the inclusions to fail")
+	}
+}
+
+func TestCodeActionResolve(t *testing.T) {
+	trans := NewFromClientTransformer("htmlT\\(`([\\s\\S]*?)`\\)", "", "html")
+	trans.Prefix = "<p>"
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x := 1\na := htmlT(` + "`" + `<b/>` + "`" + `)"}}`),
+	})
+	diagnostics := `[{"range": {"start": {"line": 0, "character": 0}, "end": {"line": 0, "character": 1}}, "message": "go"}, {"range": {"start": {"line": 1, "character": 13}, "end": {"line": 1, "character": 14}}, "message": "html"}]`
+	context := &glsp.Context{
+		Method: protocol.MethodCodeActionResolve,
+		Params: []byte(`{"title": "close", "diagnostics": ` + diagnostics + `, "data": {"lsportalUri": "file:///a.go", "lsportalRoute": "", "data": 7}}`),
+	}
+	if err := trans.TransformRequest(context); err != nil {
+		t.Fatalf("Failed to transform the resolve request: %v", err)
+	}
+	expected := `{"data":7,"diagnostics":[{"message":"html","range":{"end":{"character":17,"line":1},"start":{"character":16,"line":1}}}],"textDocument":{"uri":"file:///a.html"},"title":"close"}`
+	if string(context.Params) != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, context.Params)
+	}
+
+	var resolved any
+	json.Unmarshal([]byte(`{"title": "close", "data": 7, "edit": {"changes": {"file:///a.html": [{"range": {"start": {"line": 1, "character": 17}, "end": {"line": 1, "character": 17}}, "newText": "i"}]}}}`), &resolved)
+	if err := trans.TransformResponse(context, &resolved); err != nil {
+		t.Fatalf("Failed to transform the resolved action: %v", err)
+	}
+	got, _ := json.Marshal(resolved)
+	expected = `{"data":{"data":7,"lsportalRoute":"","lsportalUri":"file:///a.go"},"edit":{"changes":{"file:///a.go":[{"newText":"i","range":{"start":{"line":1,"character":14},"end":{"line":1,"character":14}}}]}},"title":"close"}`
+	if string(got) != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, got)
+	}
+
+	if err := trans.TransformRequest(&glsp.Context{Method: protocol.MethodCodeActionResolve, Params: []byte(`{"title": "close", "data": 7}`)}); err == nil {
+		t.Errorf("Expected resolving a code action lsportal didn't hand out to fail")
+	}
+}
@@ -0,0 +1,189 @@
+package lsportal
+
+// glsp's ServeStream sets Server.Connection without a lock and without telling anyone, while the forwarders, the
+// supervisor and the lifecycle read it from their own goroutines. So we serve the streams ourselves and keep the
+// connection of every server here, where it can be read safely and waited for.
+
+import (
+	contextpkg "context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/tliron/commonlog"
+	"github.com/tliron/glsp"
+	"github.com/tliron/glsp/server"
+)
+
+// *server.Server to the *connectionSlot of the stream it is being served on
+var connections sync.Map
+
+type connectionSlot struct {
+	lock       sync.Mutex
+	connection *jsonrpc2.Conn
+	// Closed once the connection is set, or once the slot is forgotten
+	changed chan struct{}
+	// Forgotten slots were replaced or dropped from the map, ask for the server's slot again
+	forgotten bool
+}
+
+// Serves the server on the stream until it disconnects, use this instead of server.ServeStream
+func ServeStream(server *server.Server, stream io.ReadWriteCloser) {
+	<-connect(server, stream).DisconnectNotify()
+}
+
+// Starts serving the server on the stream, the connection is forgotten again once it disconnects.
+// The server gets a new slot, a restarted inner server may connect again before its old connection was forgotten
+func connect(server *server.Server, stream io.ReadWriteCloser) *jsonrpc2.Conn {
+	var options []jsonrpc2.ConnOpt
+	if server.Debug {
+		options = append(options, jsonrpc2.LogMessages(rpcLogger{commonlog.GetLogger(server.LogBaseName + ".rpc")}))
+	}
+	connection := jsonrpc2.NewConn(server.Context, jsonrpc2.NewBufferedStream(stream, jsonrpc2.VSCodeObjectCodec{}), handlerOf(server), options...)
+	slot := &connectionSlot{connection: connection, changed: make(chan struct{})}
+	close(slot.changed)
+	if previous, ok := connections.Swap(server, slot); ok {
+		previous.(*connectionSlot).forget()
+	}
+	go func() {
+		// Drop the slot once the connection disconnects, so the server isn't kept around after its client is gone
+		<-connection.DisconnectNotify()
+		slot.forget()
+		connections.CompareAndDelete(server, slot)
+	}()
+	return connection
+}
+
+func slotOf(server *server.Server) *connectionSlot {
+	slot, _ := connections.LoadOrStore(server, &connectionSlot{changed: make(chan struct{})})
+	return slot.(*connectionSlot)
+}
+
+// Lets whoever waits on the slot know to ask for the server's slot again
+func (slot *connectionSlot) forget() {
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+	if slot.forgotten {
+		return
+	}
+	if slot.connection == nil {
+		close(slot.changed)
+	}
+	slot.connection = nil
+	slot.forgotten = true
+}
+
+// The connection the server is being served on, nil if it isn't
+func connectionOf(server *server.Server) *jsonrpc2.Conn {
+	slot := slotOf(server)
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+	return slot.connection
+}
+
+// Waits for the server to be served
+func waitForConnection(ctx contextpkg.Context, server *server.Server) (*jsonrpc2.Conn, error) {
+	for {
+		slot := slotOf(server)
+		slot.lock.Lock()
+		connection, changed, forgotten := slot.connection, slot.changed, slot.forgotten
+		slot.lock.Unlock()
+		if connection != nil {
+			return connection, nil
+		}
+		if forgotten {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s isn't connected", server.LogBaseName)
+		}
+	}
+}
+
+// What glsp does with a message, it doesn't export it
+func handlerOf(server *server.Server) jsonrpc2.Handler {
+	return jsonrpc2.HandlerWithError(func(ctx contextpkg.Context, connection *jsonrpc2.Conn, request *jsonrpc2.Request) (any, error) {
+		if !request.Notif {
+			ctx = contextpkg.WithValue(ctx, requestIDKey{}, request.ID.String())
+		}
+		context := glsp.Context{
+			Method:       request.Method,
+			Context:      ctx,
+			Notification: request.Notif,
+			Notify: func(method string, params any) {
+				if err := connection.Notify(ctx, method, params); err != nil {
+					server.Log.Errorf("%s", err.Error())
+				}
+			},
+			Call: func(method string, params any, result any) {
+				if err := connection.Call(ctx, method, params, result); err != nil {
+					server.Log.Errorf("%s", err.Error())
+				}
+			},
+		}
+		if request.Params != nil {
+			context.Params = *request.Params
+		}
+		r, validMethod, validParams, err := server.Handler.Handle(&context)
+		if request.Method == "exit" {
+			// The handler had its chance, the result doesn't matter
+			return nil, connection.Close()
+		}
+		switch {
+		case !validMethod:
+			return nil, &jsonrpc2.Error{Code: jsonrpc2.CodeMethodNotFound, Message: fmt.Sprintf("method not supported: %s", request.Method)}
+		case !validParams && err != nil:
+			return nil, &jsonrpc2.Error{Code: jsonrpc2.CodeInvalidParams, Message: err.Error()}
+		case !validParams:
+			return nil, &jsonrpc2.Error{Code: jsonrpc2.CodeInvalidParams}
+		case err != nil:
+			return nil, &jsonrpc2.Error{Code: jsonrpc2.CodeInvalidRequest, Message: err.Error()}
+		}
+		return r, nil
+	})
+}
+
+type requestIDKey struct{}
+
+// The JSON-RPC id the request came in with, empty for notifications and messages that didn't come over a connection
+func requestIDOf(ctx contextpkg.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type rpcLogger struct {
+	log commonlog.Logger
+}
+
+// ([jsonrpc2.Logger] interface)
+func (self rpcLogger) Printf(format string, v ...any) {
+	self.log.Debugf(strings.TrimSuffix(format, "\n"), v...)
+}
+
+// Our own stdin and stdout, to serve the client on
+var Stdio io.ReadWriteCloser = stdio{}
+
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdio) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdio) Close() error {
+	if err := os.Stdin.Close(); err != nil {
+		return err
+	}
+	return os.Stdout.Close()
+}
@@ -0,0 +1,73 @@
+package lsportal
+
+import (
+	contextpkg "context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tliron/glsp/server"
+)
+
+func TestWaitForConnection(t *testing.T) {
+	fromInclusion := server.NewServer(&ForwarderHandler{}, "fromInclusion", false)
+	ctx, cancel := contextpkg.WithTimeout(contextpkg.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := waitForConnection(ctx, fromInclusion); err == nil || err.Error() != "fromInclusion isn't connected" {
+		t.Errorf("Expected to time out before the server is served, Got: %v", err)
+	}
+
+	innerSide, portalSide := net.Pipe()
+	waited := make(chan error)
+	go func() {
+		_, err := waitForConnection(contextpkg.Background(), fromInclusion)
+		waited <- err
+	}()
+	served := make(chan struct{})
+	go func() {
+		ServeStream(fromInclusion, portalSide)
+		close(served)
+	}()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("Failed to wait for the connection: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected serving the server to let the waiting message through")
+	}
+
+	innerSide.Close()
+	<-served
+	// The connection is forgotten with the stream, and the server with it
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := connections.Load(fromInclusion); ok {
+		t.Errorf("Expected the connection to be forgotten once it disconnected")
+	}
+}
+
+func TestConnectBeforeForgetting(t *testing.T) {
+	fromInclusion := server.NewServer(&ForwarderHandler{}, "fromInclusion", false)
+	firstInner, firstPortal := net.Pipe()
+	first := connect(fromInclusion, firstPortal)
+	// A restarted server connects again while the first connection is still around
+	secondInner, secondPortal := net.Pipe()
+	second := connect(fromInclusion, secondPortal)
+	if connection := connectionOf(fromInclusion); connection != second {
+		t.Errorf("Expected the second connection, Got: %v", connection)
+	}
+
+	firstInner.Close()
+	<-first.DisconnectNotify()
+	time.Sleep(10 * time.Millisecond)
+	if connection := connectionOf(fromInclusion); connection != second {
+		t.Errorf("Expected the first connection disconnecting to leave the second alone, Got: %v", connection)
+	}
+
+	secondInner.Close()
+	<-second.DisconnectNotify()
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := connections.Load(fromInclusion); ok {
+		t.Errorf("Expected the connection to be forgotten once it disconnected")
+	}
+}
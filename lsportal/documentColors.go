@@ -0,0 +1,47 @@
+package lsportal
+
+// Colors and their presentations come back at virtual positions, those outside the inclusions are dropped, and so
+// are presentations whose edits would change host code. colorPresentation is asked for a range, which goes through
+// the same checks as any range request, see rangeRequests.go
+
+import (
+	"github.com/tliron/glsp"
+)
+
+// Moves the results of a documentColor or colorPresentation response into the host document, call with the lock held
+func (trans *FromClientTransformer) transformColors(context *glsp.Context, response *any) {
+	doc, open := trans.Documents[trans.UriMap[requestUri(context)]]
+	moved, _ := trans.toHost().walk(*response, &doc.SourceMap)
+	items, ok := moved.([]any)
+	if !open || !ok {
+		*response = nil
+		return
+	}
+	inInclusion := func(value any) bool {
+		r, ok := asRange(value)
+		return ok && doc.inclusionOf(r) >= 0
+	}
+	kept := []any{}
+	for _, item := range items {
+		item, _ := item.(map[string]any)
+		// ColorInformation
+		if r, ok := item["range"]; ok && !inInclusion(r) {
+			continue
+		}
+		// ColorPresentation
+		if edit, ok := item["textEdit"].(map[string]any); ok && !inInclusion(edit["range"]) {
+			continue
+		}
+		if edits, ok := item["additionalTextEdits"].([]any); ok {
+			keptEdits := []any{}
+			for _, edit := range edits {
+				if edit, ok := edit.(map[string]any); ok && inInclusion(edit["range"]) {
+					keptEdits = append(keptEdits, edit)
+				}
+			}
+			item["additionalTextEdits"] = keptEdits
+		}
+		kept = append(kept, item)
+	}
+	*response = kept
+}
@@ -0,0 +1,47 @@
+package lsportal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestTransformColors(t *testing.T) {
+	trans := NewFromClientTransformer("htmlT\\(`([\\s\\S]*?)`\\)", "", "html")
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "c := \"#fff\"\na := htmlT(` + "`" + `<b style=\"color: #000\">` + "`" + `)"}}`),
+	})
+	black := `{"start": {"line": 1, "character": 29}, "end": {"line": 1, "character": 33}}`
+	white := `{"start": {"line": 0, "character": 6}, "end": {"line": 0, "character": 10}}`
+	color := `{"red": 0, "green": 0, "blue": 0, "alpha": 1}`
+	tests := []struct {
+		name     string
+		method   string
+		response string
+		expected int
+	}{
+		{"colors outside of the inclusions are dropped", protocol.MethodTextDocumentColor, `[{"range": ` + black + `, "color": ` + color + `}, {"range": ` + white + `, "color": ` + color + `}]`, 1},
+		{"presentations editing outside of the inclusions are dropped", protocol.MethodTextDocumentColorPresentation, `[{"label": "black", "textEdit": {"range": ` + black + `, "newText": "black"}}, {"label": "white", "textEdit": {"range": ` + white + `, "newText": "white"}}]`, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response any
+			json.Unmarshal([]byte(test.response), &response)
+			trans.TransformResponse(&glsp.Context{Method: test.method, Params: []byte(`{"textDocument": {"uri": "file:///a.html"}}`)}, &response)
+			if items, _ := response.([]any); len(items) != test.expected {
+				t.Errorf("Expected %d, Got: %v", test.expected, response)
+			}
+		})
+	}
+
+	context := &glsp.Context{
+		Method: protocol.MethodTextDocumentColorPresentation,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go"}, "color": ` + color + `, "range": ` + white + `}`),
+	}
+	if err := trans.TransformRequest(context); err == nil {
+		t.Errorf("Expected the presentation of a color outside of the inclusions to be answered right away")
+	}
+}
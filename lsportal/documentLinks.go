@@ -0,0 +1,53 @@
+package lsportal
+
+// Document links come back at virtual positions with targets the inner server resolved against the virtual document,
+// eg: file:///project/a.html#top. Links outside the inclusions are dropped, links to a virtual document go to its host
+// and relative targets are resolved against the host file's directory.
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/tliron/glsp"
+)
+
+// Moves the links of a documentLink response into the host document, call with the lock held
+func (trans *FromClientTransformer) transformDocumentLinks(context *glsp.Context, response *any) {
+	hostUri := trans.UriMap[requestUri(context)]
+	doc, open := trans.Documents[hostUri]
+	moved, _ := trans.toHost().walk(*response, &doc.SourceMap)
+	links, ok := moved.([]any)
+	if !open || !ok {
+		*response = nil
+		return
+	}
+	kept := []any{}
+	for _, link := range links {
+		link, _ := link.(map[string]any)
+		if r, ok := asRange(link["range"]); !ok || doc.inclusionOf(r) < 0 {
+			continue
+		}
+		if target, ok := link["target"].(string); ok {
+			link["target"] = trans.linkTarget(hostUri, target)
+		}
+		kept = append(kept, link)
+	}
+	*response = kept
+}
+
+// Where a link of the host document leads
+func (trans *FromClientTransformer) linkTarget(hostUri string, target string) string {
+	withoutFragment, _, _ := strings.Cut(target, "#")
+	if host, ok := trans.UriMap[withoutFragment]; ok {
+		return host + target[len(withoutFragment):]
+	}
+	ref, err := url.Parse(target)
+	if err != nil || ref.IsAbs() {
+		return target
+	}
+	base, err := url.Parse(hostUri)
+	if err != nil {
+		return target
+	}
+	return base.ResolveReference(ref).String()
+}
@@ -0,0 +1,42 @@
+package lsportal
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestTransformDocumentLinks(t *testing.T) {
+	trans := NewFromClientTransformer("htmlT\\(`([\\s\\S]*?)`\\)", "", "html")
+	trans.Prefix = "<p>"
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///project/pages/a.go", "languageId": "go", "version": 1, "text": "x := 1\na := htmlT(` + "`" + `<a href=\"b.html\">` + "`" + `)"}}`),
+	})
+	link := func(line, startChar, endChar int, target string) string {
+		return fmt.Sprintf(`{"range": {"start": {"line": %d, "character": %d}, "end": {"line": %d, "character": %d}}, "target": %q}`, line, startChar, line, endChar, target)
+	}
+	tests := []struct {
+		name     string
+		link     string
+		expected string
+	}{
+		{"relative targets are resolved against the host", link(1, 24, 30, "b.html"), `[{"range":{"end":{"character":27,"line":1},"start":{"character":21,"line":1}},"target":"file:///project/pages/b.html"}]`},
+		{"links to the virtual document go to the host", link(1, 24, 30, "file:///project/pages/a.html#top"), `[{"range":{"end":{"character":27,"line":1},"start":{"character":21,"line":1}},"target":"file:///project/pages/a.go#top"}]`},
+		{"absolute targets stay", link(1, 24, 30, "https://example.com/b.html"), `[{"range":{"end":{"character":27,"line":1},"start":{"character":21,"line":1}},"target":"https://example.com/b.html"}]`},
+		{"links outside of the inclusions are dropped", link(0, 0, 1, "x.html"), `[]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response any
+			json.Unmarshal([]byte("["+test.link+"]"), &response)
+			trans.TransformResponse(&glsp.Context{Method: protocol.MethodTextDocumentDocumentLink, Params: []byte(`{"textDocument": {"uri": "file:///project/pages/a.html"}}`)}, &response)
+			if got, _ := json.Marshal(response); string(got) != test.expected {
+				t.Errorf("Expected: %s, Got: %s", test.expected, got)
+			}
+		})
+	}
+}
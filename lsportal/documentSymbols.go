@@ -0,0 +1,154 @@
+package lsportal
+
+// The inner server sees the whole virtual document, so it may report symbols spanning the blanked out host code,
+// eg: the html element wrapping a fragment. We keep the symbols within inclusions, promoting the children of the ones
+// that aren't, and can group them under a symbol for each inclusion named after the host call around it.
+// Servers answer with either nested DocumentSymbols or flat SymbolInformation, in which case the group becomes the
+// containerName.
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
+)
+
+// How far back from an inclusion we look for the call it is an argument of
+const hostCallLookBehind = 200
+
+// The function called right before the inclusion, eg: htmlT in htmlT(`...`)
+var hostCallRegex = regexp.MustCompile(`([A-Za-z_][\w.]*)\s*\(\s*[^\w\s]*$`)
+
+// Scopes the document symbols to the inclusions and moves them into the host. The symbols are scoped while they are
+// still in the virtual document: a symbol wrapping an injected prefix or suffix can't be moved into the host, which would
+// lose its children with it
+func (trans *FromClientTransformer) transformDocumentSymbols(context *glsp.Context, response *any) {
+	doc, found := trans.Documents[trans.UriMap[requestUri(context)]]
+	if symbols, ok := (*response).([]any); ok && found {
+		*response = scopeSymbols(&doc, symbols)
+	}
+	newResponse, ok := trans.toHost().walkFields(*response, trans.toHost().requestSourceMap(context))
+	if !ok {
+		*response = nil
+		return
+	}
+	if symbols, ok := newResponse.([]any); ok && found && trans.GroupSymbols {
+		newResponse = groupSymbols(&doc, symbols)
+	}
+	*response = newResponse
+}
+
+// Keeps the virtual document's symbols that are within an inclusion
+func scopeSymbols(doc *TextDocument, symbols []any) []any {
+	var inclusions []Range
+	for _, inclusion := range doc.Inclusions {
+		if virtual, ok := doc.SourceMap.RangeToVirtual(inclusion); ok {
+			inclusions = append(inclusions, virtual)
+		}
+	}
+	inside := func(r Range) bool {
+		for _, inclusion := range inclusions {
+			if isInRange(inclusion, r.Start) && isInRange(inclusion, r.End) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(symbols) > 0 && isSymbolInformation(symbols[0]) {
+		kept := []any{}
+		for _, symbol := range symbols {
+			location, _ := symbol.(map[string]any)["location"].(map[string]any)
+			if r, ok := asRange(location["range"]); ok && inside(r) {
+				kept = append(kept, symbol)
+			}
+		}
+		return kept
+	}
+	return keepSymbols(symbols, inside)
+}
+
+// Groups the host document's symbols under a symbol for each inclusion, or its name as the container of flat ones
+func groupSymbols(doc *TextDocument, symbols []any) []any {
+	if len(symbols) > 0 && isSymbolInformation(symbols[0]) {
+		for _, symbol := range symbols {
+			symbol := symbol.(map[string]any)
+			location, _ := symbol["location"].(map[string]any)
+			r, _ := asRange(location["range"])
+			if container, _ := symbol["containerName"].(string); container == "" {
+				if i := doc.inclusionOf(r); i >= 0 {
+					symbol["containerName"] = hostCallName(doc, i)
+				}
+			}
+		}
+		return symbols
+	}
+
+	groups := make([][]any, len(doc.Inclusions))
+	for _, symbol := range symbols {
+		r, _ := asRange(symbol.(map[string]any)["range"])
+		if i := doc.inclusionOf(r); i >= 0 {
+			groups[i] = append(groups[i], symbol)
+		}
+	}
+	grouped := []any{}
+	for i, children := range groups {
+		if len(children) == 0 {
+			continue
+		}
+		inclusion := doc.Inclusions[i]
+		grouped = append(grouped, map[string]any{
+			"name":           hostCallName(doc, i),
+			"kind":           SymbolKindModule,
+			"range":          inclusion,
+			"selectionRange": Range{Start: inclusion.Start, End: inclusion.Start},
+			"children":       children,
+		})
+	}
+	return grouped
+}
+
+// Keeps the DocumentSymbols whose range is inside, putting the kept children of the others in their place
+func keepSymbols(symbols []any, inside func(Range) bool) []any {
+	kept := []any{}
+	for _, symbol := range symbols {
+		symbol, ok := symbol.(map[string]any)
+		if !ok {
+			continue
+		}
+		children, _ := symbol["children"].([]any)
+		children = keepSymbols(children, inside)
+		if r, ok := asRange(symbol["range"]); ok && inside(r) {
+			if len(children) > 0 {
+				symbol["children"] = children
+			} else {
+				delete(symbol, "children")
+			}
+			kept = append(kept, symbol)
+		} else {
+			kept = append(kept, children...)
+		}
+	}
+	return kept
+}
+
+func isSymbolInformation(symbol any) bool {
+	object, ok := symbol.(map[string]any)
+	if !ok {
+		return false
+	}
+	_, ok = object["location"]
+	return ok
+}
+
+// Names an inclusion after the host call it is an argument of, eg: htmlT @ line 27
+func hostCallName(doc *TextDocument, inclusion int) string {
+	start := doc.Inclusions[inclusion].Start
+	runes := []rune(doc.Text)
+	offset := getOffset(start, findLineEnds(runes), len(runes))
+	name := "inclusion"
+	if match := hostCallRegex.FindStringSubmatch(string(runes[max(0, offset-hostCallLookBehind):offset])); match != nil {
+		name = match[1]
+	}
+	return fmt.Sprintf("%s @ line %d", name, start.Line+1)
+}
@@ -0,0 +1,81 @@
+package lsportal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+// Renders the names of nested symbols, eg: a[b c], with the container of flat ones, eg: b<a>
+func symbolNames(symbols any) string {
+	var names []string
+	items, _ := symbols.([]any)
+	for _, symbol := range items {
+		symbol := symbol.(map[string]any)
+		name := symbol["name"].(string)
+		if children, ok := symbol["children"]; ok {
+			name += "[" + symbolNames(children) + "]"
+		}
+		if container, ok := symbol["containerName"]; ok {
+			name += fmt.Sprintf("<%s>", container)
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestScopeSymbols(t *testing.T) {
+	symbol := func(name string, startLine, startChar, endLine, endChar int, children string) string {
+		r := fmt.Sprintf(`{"start": {"line": %d, "character": %d}, "end": {"line": %d, "character": %d}}`, startLine, startChar, endLine, endChar)
+		return fmt.Sprintf(`{"name": %q, "kind": 8, "range": %s, "selectionRange": %s, "children": [%s]}`, name, r, r, children)
+	}
+	information := func(name string, startLine, startChar, endLine, endChar int) string {
+		return fmt.Sprintf(`{"name": %q, "kind": 8, "location": {"uri": "file:///a.html", "range": {"start": {"line": %d, "character": %d}, "end": {"line": %d, "character": %d}}}}`,
+			name, startLine, startChar, endLine, endChar)
+	}
+	nested := "[" + symbol("html", 0, 0, 3, 22, symbol("div", 1, 12, 2, 15, symbol("p", 2, 0, 2, 9, ""))+","+symbol("b", 3, 12, 3, 20, "")) + "]"
+	flat := "[" + information("x", 0, 0, 0, 1) + "," + information("div", 1, 12, 1, 17) + "]"
+	// With the prefix "function _(){" and suffix "}" the inner server sees a function wrapping the last inclusion
+	wrapped := "[" + symbol("_", 3, 12, 3, 34, symbol("b", 3, 25, 3, 33, "")) + "]"
+
+	tests := []struct {
+		name     string
+		group    bool
+		prefix   bool
+		response string
+		expected string
+	}{
+		{"symbols outside inclusions are dropped and their children promoted", false, false, nested, "div[p] b"},
+		{"symbols are grouped by inclusion", true, false, nested, "htmlT @ line 2[div[p]] htmlT @ line 4[b]"},
+		{"symbol information outside inclusions is dropped", false, false, flat, "div"},
+		{"symbol information is grouped by container", true, false, flat, "div<htmlT @ line 2>"},
+		{"symbols wrapping the prefix are dropped and their children promoted", false, true, wrapped, "b"},
+		{"symbols within the prefix and suffix are grouped by inclusion", true, true, wrapped, "htmlT @ line 4[b]"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trans := NewFromClientTransformer("htmlT\\(`([\\s\\S]*?)`\\)", "", "html")
+			trans.GroupSymbols = test.group
+			if test.prefix {
+				trans.Prefix, trans.Suffix = "function _(){", "}"
+			}
+			trans.TransformRequest(&glsp.Context{
+				Method: protocol.MethodTextDocumentDidOpen,
+				Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x := 1\na := htmlT(` + "`" + `<div>\n<p>hi</p></div>` + "`" + `)\nb := htmlT(` + "`" + `<b>x</b>` + "`" + `)"}}`),
+			})
+			var response any
+			json.Unmarshal([]byte(test.response), &response)
+			trans.TransformResponse(&glsp.Context{
+				Method: protocol.MethodTextDocumentDocumentSymbol,
+				Params: []byte(`{"textDocument": {"uri": "file:///a.html"}}`),
+			}, &response)
+			if got := symbolNames(response); got != test.expected {
+				t.Errorf("Expected: %s, Got: %s", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package lsportal
+
+import (
+	"main/lsportal/lsptest"
+	"testing"
+
+	"github.com/tliron/glsp/server"
+)
+
+// Connects every route to a fake inclusion server of its own, the servers are in the order of the routes and closed
+// with the test. Send the client's messages straight to fromClient's handler, or over connectClient
+func serveRoutes(t *testing.T, routes ...Route) (*server.Server, []*Inclusion, []*lsptest.Server) {
+	fromClient, inclusions, _ := InitRoutes(false, routes)
+	var inners []*lsptest.Server
+	for _, inclusion := range inclusions {
+		innerSide, portalSide := lsptest.Pipe()
+		go ServeStream(inclusion.Server, portalSide)
+		inner := lsptest.NewServer()
+		inner.Serve(innerSide)
+		t.Cleanup(func() { inner.Close() })
+		inners = append(inners, inner)
+	}
+	return fromClient, inclusions, inners
+}
+
+// serveRoutes with a single route
+func serveRoute(t *testing.T, route Route) (*server.Server, *Inclusion, *lsptest.Server) {
+	fromClient, inclusions, inners := serveRoutes(t, route)
+	return fromClient, inclusions[0], inners[0]
+}
+
+// A fake editor connected to fromClient, closed with the test
+func connectClient(t *testing.T, fromClient *server.Server) *lsptest.Client {
+	clientSide, portalSide := lsptest.Pipe()
+	go ServeStream(fromClient, portalSide)
+	client := lsptest.NewClient(clientSide)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
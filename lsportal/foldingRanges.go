@@ -0,0 +1,85 @@
+package lsportal
+
+// Folding ranges are lines rather than positions, so the walk leaves them alone. The inner server folds the blanked
+// out host code around the inclusions too, those are dropped and the rest moved into the host.
+// With FoldInclusions every inclusion spanning several lines gets a region of its own, so the embedded block itself
+// can be folded. Its closing line stays visible if nothing but whitespace of the inclusion is on it.
+
+import (
+	"strings"
+
+	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
+)
+
+// Moves the folding ranges of a foldingRange response into the host document, call with the lock held
+func (trans *FromClientTransformer) transformFoldingRanges(context *glsp.Context, response *any) {
+	var ranges []FoldingRange
+	doc, open := trans.Documents[trans.UriMap[requestUri(context)]]
+	if !open || !remarshal(*response, &ranges) {
+		*response = nil
+		return
+	}
+	kept := []FoldingRange{}
+	folded := map[[2]UInteger]bool{}
+	for _, foldingRange := range ranges {
+		start, ok := doc.SourceMap.ToHost(Position{Line: foldingRange.StartLine, Character: valueOr(foldingRange.StartCharacter, 0)})
+		if !ok {
+			continue
+		}
+		end, ok := doc.SourceMap.ToHost(Position{Line: foldingRange.EndLine, Character: valueOr(foldingRange.EndCharacter, 0)})
+		if !ok || !doc.foldsWithinInclusion(start.Line, end.Line) {
+			continue
+		}
+		foldingRange.StartLine, foldingRange.EndLine = start.Line, end.Line
+		if foldingRange.StartCharacter != nil {
+			foldingRange.StartCharacter = &start.Character
+		}
+		if foldingRange.EndCharacter != nil {
+			foldingRange.EndCharacter = &end.Character
+		}
+		folded[[2]UInteger{start.Line, end.Line}] = true
+		kept = append(kept, foldingRange)
+	}
+	if trans.FoldInclusions {
+		region := string(FoldingRangeKindRegion)
+		for i := range doc.Inclusions {
+			start, end, ok := doc.inclusionFold(i)
+			if !ok || folded[[2]UInteger{start, end}] {
+				continue
+			}
+			kept = append(kept, FoldingRange{StartLine: start, EndLine: end, Kind: &region})
+		}
+	}
+	*response = kept
+}
+
+// Checks that the lines lie within a single inclusion
+func (textDocument *TextDocument) foldsWithinInclusion(startLine UInteger, endLine UInteger) bool {
+	for _, inclusion := range textDocument.Inclusions {
+		if inclusion.Start.Line <= startLine && endLine <= inclusion.End.Line {
+			return true
+		}
+	}
+	return false
+}
+
+// The lines to fold for an inclusion, false if it fits on one line
+func (textDocument *TextDocument) inclusionFold(i int) (UInteger, UInteger, bool) {
+	inclusion := textDocument.Inclusions[i]
+	end := inclusion.End.Line
+	lines := strings.Split(textDocument.Text, "\n")
+	if int(end) < len(lines) {
+		if last := []rune(lines[end]); int(inclusion.End.Character) <= len(last) && strings.TrimSpace(string(last[:inclusion.End.Character])) == "" {
+			end--
+		}
+	}
+	return inclusion.Start.Line, end, end > inclusion.Start.Line
+}
+
+func valueOr[T any](value *T, fallback T) T {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
@@ -0,0 +1,37 @@
+package lsportal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestTransformFoldingRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		fold     bool
+		expected string
+	}{
+		{"ranges outside of the inclusions are dropped", false, `[{"startLine":2,"endLine":3}]`},
+		{"inclusions get a region", true, `[{"startLine":2,"endLine":3},{"startLine":1,"endLine":4,"kind":"region"}]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trans := NewFromClientTransformer("htmlT\\(`([\\s\\S]*?)`\\)", "", "html")
+			trans.FoldInclusions = test.fold
+			trans.TransformRequest(&glsp.Context{
+				Method: protocol.MethodTextDocumentDidOpen,
+				Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "func f() {\n\ta := htmlT(` + "`" + `\n\t\t<div>\n\t\t\t<p>hi</p>\n\t\t</div>\n\t` + "`" + `)\n\tb := htmlT(` + "`" + `<b/>` + "`" + `)\n}"}}`),
+			})
+			var response any
+			// The function around the inclusion and the div in it
+			json.Unmarshal([]byte(`[{"startLine": 0, "endLine": 6}, {"startLine": 2, "endLine": 3}]`), &response)
+			trans.TransformResponse(&glsp.Context{Method: protocol.MethodTextDocumentFoldingRange, Params: []byte(`{"textDocument": {"uri": "file:///a.html"}}`)}, &response)
+			if got, _ := json.Marshal(response); string(got) != test.expected {
+				t.Errorf("Expected: %s, Got: %s", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package lsportal
+
+// Formatting the whole virtual document would reflow the blanked out host code around the inclusions. Instead we ask
+// the inner server to format each inclusion on its own with rangeFormatting, and replace the inclusion with the result
+// re-indented to sit where it did in the host: the whitespace it started and ended with is kept and its lines are
+// indented like the first line of the original.
+// Inclusions with exclusions in them are left alone, the formatter can't know where the host code it never saw goes.
+// Inner servers without rangeFormatting format the whole virtual document once instead, and each inclusion takes the
+// edits touching it.
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
+)
+
+// An inclusion to format
+type formattingTarget struct {
+	host    Range
+	virtual Range
+	// The text of the inclusion in the host
+	original string
+	// The indentation of the host line the inclusion starts on
+	lineIndent string
+}
+
+func isFormattingMethod(method string) bool {
+	return method == MethodTextDocumentFormatting || method == MethodTextDocumentRangeFormatting
+}
+
+// Formats the inclusions of the document one by one, the context holds the request as it was transformed and id is
+// its trace id. Returns the edits for the host document and how long the inner server took
+func (self *ForwarderHandler) formatInclusions(context *glsp.Context, id string) (any, time.Duration, error) {
+	var inner time.Duration
+	var params struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+		// Only for rangeFormatting, inclusions overlapping it are formatted
+		Range   *Range         `json:"range"`
+		Options map[string]any `json:"options"`
+	}
+	if err := json.Unmarshal(context.Params, &params); err != nil {
+		return nil, inner, err
+	}
+	trans := self.inclusion.transformer
+	targets, virtualText := trans.formattingTargets(params.TextDocument.URI, params.Range)
+	edits := []TextEdit{}
+	rangeFormatting := true
+	// The edits of formatting the whole virtual document, once rangeFormatting turned out to be missing
+	var documentEdits []TextEdit
+	for _, target := range targets {
+		innerEdits := documentEdits
+		if rangeFormatting {
+			res, took, err := self.forwardFormatting(context, id, MethodTextDocumentRangeFormatting, map[string]any{"textDocument": params.TextDocument, "range": target.virtual, "options": params.Options})
+			inner += took
+			var rpcErr *jsonrpc2.Error
+			if errors.As(err, &rpcErr) && rpcErr.Code == jsonrpc2.CodeMethodNotFound {
+				self.logger.Warningf("%s doesn't support rangeFormatting, formatting the whole document instead", self.otherServer.LogBaseName)
+				rangeFormatting = false
+				res, took, err = self.forwardFormatting(context, id, MethodTextDocumentFormatting, map[string]any{"textDocument": params.TextDocument, "options": params.Options})
+				inner += took
+			}
+			if err != nil {
+				return nil, inner, err
+			}
+			innerEdits = nil
+			if !remarshal(*res, &innerEdits) {
+				continue
+			}
+			if !rangeFormatting {
+				documentEdits = innerEdits
+			}
+		}
+		formatted := stripInjected(target.apply(virtualText, innerEdits), trans.Prefix, trans.Suffix)
+		if newText := reindent(formatted, target.original, target.lineIndent); newText != target.original {
+			edits = append(edits, TextEdit{Range: target.host, NewText: newText})
+		}
+	}
+	return edits, inner, nil
+}
+
+// Sends one of the formatting requests of the client's request on to the inner server, traced as part of it
+func (self *ForwarderHandler) forwardFormatting(context *glsp.Context, id string, method string, params any) (*any, time.Duration, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, 0, err
+	}
+	request := &glsp.Context{Method: method, Params: raw, Context: context.Context}
+	self.tracer.message(self.hops.out, id, "", "request", method, self.route, request.Params)
+	sent := time.Now()
+	_, forwardSpan := startSpan(context.Context, "forward "+method, spanClient)
+	res, err := self.forwardMessage(request, id)
+	forwardSpan.end(err)
+	if err != nil {
+		self.tracer.response(self.hops.responseIn, id, "", method, self.route, nil, err, sent)
+		return nil, time.Since(sent), err
+	}
+	self.tracer.response(self.hops.responseIn, id, "", method, self.route, *res, nil, sent)
+	return res, time.Since(sent), nil
+}
+
+// The inclusions of the document to format and the text of its virtual document, virtualRange limits them to the
+// ones overlapping it
+func (trans *FromClientTransformer) formattingTargets(virtualUri string, virtualRange *Range) ([]formattingTarget, []rune) {
+	trans.lock.RLock()
+	defer trans.lock.RUnlock()
+	doc, ok := trans.Documents[trans.UriMap[virtualUri]]
+	if !ok {
+		return nil, nil
+	}
+	hostText := []rune(doc.Text)
+	hostLineEnds := findLineEnds(hostText)
+	virtualText := []rune(isolateInclusions(doc.Text, trans.isolation()).Text)
+	virtualLineEnds := findLineEnds(virtualText)
+
+	var targets []formattingTarget
+	for _, inclusion := range doc.Inclusions {
+		virtual, ok := doc.SourceMap.RangeToVirtual(inclusion)
+		if !ok {
+			continue
+		}
+		if virtualRange != nil && (comparePositions(virtual.End, virtualRange.Start) < 0 || comparePositions(virtual.Start, virtualRange.End) > 0) {
+			continue
+		}
+		original := string(hostText[getOffset(inclusion.Start, hostLineEnds, len(hostText)):getOffset(inclusion.End, hostLineEnds, len(hostText))])
+		if string(virtualText[getOffset(virtual.Start, virtualLineEnds, len(virtualText)):getOffset(virtual.End, virtualLineEnds, len(virtualText))]) != original {
+			trans.logger.Infof("not formatting the inclusion on line %d, it has exclusions", inclusion.Start.Line+1)
+			continue
+		}
+		lineStart := getOffset(Position{Line: inclusion.Start.Line}, hostLineEnds, len(hostText))
+		line := string(hostText[lineStart:getOffset(inclusion.Start, hostLineEnds, len(hostText))])
+		targets = append(targets, formattingTarget{
+			host:       inclusion,
+			virtual:    virtual,
+			original:   original,
+			lineIndent: line[:len(line)-len(strings.TrimLeftFunc(line, unicode.IsSpace))],
+		})
+	}
+	return targets, virtualText
+}
+
+// Applies the edits touching the inclusion to the virtual text, returning the new text of the inclusion and of the
+// blanked out host code around it that the edits reached into
+func (target formattingTarget) apply(virtualText []rune, edits []TextEdit) string {
+	lineEnds := findLineEnds(virtualText)
+	start, end := getOffset(target.virtual.Start, lineEnds, len(virtualText)), getOffset(target.virtual.End, lineEnds, len(virtualText))
+	type offsetEdit struct {
+		start, end int
+		text       string
+	}
+	var offsetEdits []offsetEdit
+	regionStart, regionEnd := start, end
+	for _, edit := range edits {
+		editStart, editEnd := getOffset(edit.Range.Start, lineEnds, len(virtualText)), getOffset(edit.Range.End, lineEnds, len(virtualText))
+		// Edits running past the end are clamped by getOffset, backwards ones can't be applied
+		if editEnd < start || editStart > end || editStart > editEnd {
+			continue
+		}
+		offsetEdits = append(offsetEdits, offsetEdit{editStart, editEnd, edit.NewText})
+		regionStart, regionEnd = min(regionStart, editStart), max(regionEnd, editEnd)
+	}
+	// Back to front so the offsets stay put
+	sort.Slice(offsetEdits, func(i, j int) bool { return offsetEdits[i].start > offsetEdits[j].start })
+	region := append([]rune(nil), virtualText[regionStart:regionEnd]...)
+	for _, edit := range offsetEdits {
+		region = append(region[:edit.start-regionStart], append([]rune(edit.text), region[edit.end-regionStart:]...)...)
+	}
+	return string(region)
+}
+
+// Drops the prefix and suffix the formatter saw if its edits reached into them
+func stripInjected(formatted string, prefix string, suffix string) string {
+	if prefix = strings.TrimSpace(prefix); prefix != "" {
+		if trimmed := strings.TrimLeftFunc(formatted, unicode.IsSpace); strings.HasPrefix(trimmed, prefix) {
+			formatted = trimmed[len(prefix):]
+		}
+	}
+	if suffix = strings.TrimSpace(suffix); suffix != "" {
+		if trimmed := strings.TrimRightFunc(formatted, unicode.IsSpace); strings.HasSuffix(trimmed, suffix) {
+			formatted = trimmed[:len(trimmed)-len(suffix)]
+		}
+	}
+	return formatted
+}
+
+// Fits the formatted snippet into the host: it keeps the whitespace the original started and ended with, and its lines
+// are indented like the first line of the original that starts a line, or else like the host line
+func reindent(formatted string, original string, lineIndent string) string {
+	body := strings.TrimFunc(original, unicode.IsSpace)
+	if body == "" {
+		return original
+	}
+	leading := original[:strings.Index(original, body)]
+	trailing := original[len(leading)+len(body):]
+	// A first line of its own is indented like the rest
+	if newline := strings.LastIndex(leading, "\n"); newline >= 0 {
+		leading = leading[:newline+1]
+	}
+	indent := lineIndent
+	for i, line := range strings.Split(original, "\n") {
+		if trimmed := strings.TrimLeftFunc(line, unicode.IsSpace); i > 0 && trimmed != "" {
+			indent = line[:len(line)-len(trimmed)]
+			break
+		}
+	}
+
+	lines := strings.Split(formatted, "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return original
+	}
+	// The formatter indents relative to where it thinks the snippet is, keep only the indentation within it
+	common := -1
+	for _, line := range lines {
+		if trimmed := strings.TrimLeftFunc(line, unicode.IsSpace); trimmed != "" {
+			if width := len(line) - len(trimmed); common < 0 || width < common {
+				common = width
+			}
+		}
+	}
+	var out strings.Builder
+	out.WriteString(leading)
+	for i, line := range lines {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		if line == "" {
+			continue
+		}
+		if i > 0 || strings.Contains(leading, "\n") {
+			out.WriteString(indent)
+		}
+		out.WriteString(line[min(common, len(line)-len(strings.TrimLeftFunc(line, unicode.IsSpace))):])
+	}
+	out.WriteString(trailing)
+	return out.String()
+}
+
+func comparePositions(a Position, b Position) int {
+	if a.Line != b.Line {
+		if a.Line < b.Line {
+			return -1
+		}
+		return 1
+	}
+	if a.Character != b.Character {
+		if a.Character < b.Character {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package lsportal
+
+import (
+	"bytes"
+	contextpkg "context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestReindent(t *testing.T) {
+	tests := []struct {
+		name       string
+		formatted  string
+		original   string
+		lineIndent string
+		expected   string
+	}{
+		{"multi-line literal", "\n  <div>\n    <p>hi</p>\n  </div>\n", "\n\t\t<div><p>hi</p></div>\n\t", "\t", "\n\t\t<div>\n\t\t  <p>hi</p>\n\t\t</div>\n\t"},
+		{"inline literal", "           <b>\n             x\n           </b>", "<b>x</b>", "\t", "<b>\n\t  x\n\t</b>"},
+		{"blank lines stay empty", "<a/>\n\n<b/>", " <a/><b/> ", "", " <a/>\n\n<b/> "},
+		{"nothing to format", "", "\n\t", "", "\n\t"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := reindent(test.formatted, test.original, test.lineIndent); got != test.expected {
+				t.Errorf("Expected: %q, Got: %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestFormatInclusions(t *testing.T) {
+	fromClient, inclusion, server := serveRoute(t, Route{Isolation: Isolation{Regex: "htmlT\\(`([\\s\\S]*?)`\\)", ExclusionRegex: `({{[\s\S]*?}})`}, Extension: "html"})
+	var trace bytes.Buffer
+	inclusion.Trace(NewTracer(&trace))
+	// Puts every tag on a line of its own, indented from the start of the line the range starts on
+	server.Handle(protocol.MethodTextDocumentRangeFormatting, func(raw json.RawMessage) (any, error) {
+		var params protocol.DocumentRangeFormattingParams
+		json.Unmarshal(raw, &params)
+		start := protocol.Position{Line: params.Range.Start.Line}
+		switch params.Range.Start.Line {
+		case 1:
+			return []protocol.TextEdit{{Range: protocol.Range{Start: start, End: params.Range.End}, NewText: "\n  <div>\n    <p>hi</p>\n  </div>\n"}}, nil
+		case 4:
+			return []protocol.TextEdit{{Range: params.Range, NewText: "<b>x</b>"}}, nil
+		}
+		t.Errorf("Expected only inclusions without exclusions to be formatted, Got: %v", params.Range)
+		return nil, nil
+	})
+
+	text := "func page() {\n\ta := htmlT(`\n\t\t<div><p>hi</p></div>\n\t`)\n\tb := htmlT(`<b>x</b>`)\n\tc := htmlT(`<i>{{.X}}</i>`)\n}"
+	open, _ := json.Marshal(protocol.DidOpenTextDocumentParams{TextDocument: protocol.TextDocumentItem{URI: "file:///a.go", LanguageID: "go", Version: 1, Text: text}})
+	fromClient.Handler.Handle(&glsp.Context{Method: protocol.MethodTextDocumentDidOpen, Params: open, Notification: true, Context: contextpkg.Background()})
+	r, _, _, err := fromClient.Handler.Handle(&glsp.Context{
+		Method:  protocol.MethodTextDocumentFormatting,
+		Params:  []byte(`{"textDocument": {"uri": "file:///a.go"}, "options": {"tabSize": 2, "insertSpaces": true}}`),
+		Context: contextpkg.Background(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to format: %v", err)
+	}
+	expected := []protocol.TextEdit{{
+		Range:   protocol.Range{Start: protocol.Position{Line: 1, Character: 13}, End: protocol.Position{Line: 3, Character: 1}},
+		NewText: "\n\t\t<div>\n\t\t  <p>hi</p>\n\t\t</div>\n\t",
+	}}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expected only the changed inclusion to be replaced, re-indented, Got: %#v", r)
+	}
+	// One request from the client, sent on as a rangeFormatting for each inclusion without exclusions
+	hops := map[Hop]int{}
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		var entry TraceEntry
+		if json.Unmarshal([]byte(line), &entry) == nil && entry.Method != protocol.MethodTextDocumentDidOpen {
+			hops[entry.Hop]++
+		}
+	}
+	if expected := map[Hop]int{HopClientToPortal: 1, HopPortalToInner: 2, HopInnerToPortal: 2, HopPortalToClient: 1}; !reflect.DeepEqual(hops, expected) {
+		t.Errorf("Expected the formatting in the trace: %v, Got: %v", expected, hops)
+	}
+}
+
+func TestFormatInclusionsWithoutRangeFormatting(t *testing.T) {
+	fromClient, _, server := serveRoute(t, Route{Isolation: Isolation{Regex: "htmlT\\(`([\\s\\S]*?)`\\)"}, Extension: "html"})
+	// Only formats whole documents, making every bold tag italic
+	server.Handle(protocol.MethodTextDocumentFormatting, func(raw json.RawMessage) (any, error) {
+		return []protocol.TextEdit{
+			{Range: protocol.Range{Start: protocol.Position{Line: 1, Character: 13}, End: protocol.Position{Line: 1, Character: 21}}, NewText: "<i>x</i>"},
+			{Range: protocol.Range{Start: protocol.Position{Line: 2, Character: 13}, End: protocol.Position{Line: 2, Character: 21}}, NewText: "<i>y</i>"},
+		}, nil
+	})
+
+	text := "func page() {\n\ta := htmlT(`<b>x</b>`)\n\tb := htmlT(`<b>y</b>`)\n}"
+	open, _ := json.Marshal(protocol.DidOpenTextDocumentParams{TextDocument: protocol.TextDocumentItem{URI: "file:///a.go", LanguageID: "go", Version: 1, Text: text}})
+	fromClient.Handler.Handle(&glsp.Context{Method: protocol.MethodTextDocumentDidOpen, Params: open, Notification: true, Context: contextpkg.Background()})
+	r, _, _, err := fromClient.Handler.Handle(&glsp.Context{
+		Method:  protocol.MethodTextDocumentFormatting,
+		Params:  []byte(`{"textDocument": {"uri": "file:///a.go"}, "options": {"tabSize": 2, "insertSpaces": true}}`),
+		Context: contextpkg.Background(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to format: %v", err)
+	}
+	expected := []protocol.TextEdit{
+		{Range: protocol.Range{Start: protocol.Position{Line: 1, Character: 13}, End: protocol.Position{Line: 1, Character: 21}}, NewText: "<i>x</i>"},
+		{Range: protocol.Range{Start: protocol.Position{Line: 2, Character: 13}, End: protocol.Position{Line: 2, Character: 21}}, NewText: "<i>y</i>"},
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expected the edits of formatting the whole document, Got: %#v", r)
+	}
+	formattings := 0
+	for _, message := range server.Received() {
+		if message.Method == protocol.MethodTextDocumentFormatting {
+			formattings++
+		}
+	}
+	if formattings != 1 {
+		t.Errorf("Expected the whole document to be formatted once, Got: %d", formattings)
+	}
+}
+
+func TestFormattingTargetApply(t *testing.T) {
+	virtualText := []rune("a\nbc\nxyz")
+	target := formattingTarget{virtual: protocol.Range{Start: protocol.Position{Line: 2, Character: 0}, End: protocol.Position{Line: 2, Character: 3}}}
+	edit := func(startLine, startCharacter, endLine, endCharacter uint32, text string) protocol.TextEdit {
+		return protocol.TextEdit{Range: protocol.Range{
+			Start: protocol.Position{Line: startLine, Character: startCharacter},
+			End:   protocol.Position{Line: endLine, Character: endCharacter},
+		}, NewText: text}
+	}
+	tests := []struct {
+		name     string
+		edits    []protocol.TextEdit
+		expected string
+	}{
+		{"within the inclusion", []protocol.TextEdit{edit(2, 1, 2, 2, "Y")}, "xYz"},
+		{"past the end of the last line", []protocol.TextEdit{edit(2, 1, 2, 50, "YZ")}, "xYZ"},
+		{"past the last line", []protocol.TextEdit{edit(2, 0, 9, 0, "XYZ")}, "XYZ"},
+		{"backwards", []protocol.TextEdit{edit(2, 2, 2, 1, "Y")}, "xyz"},
+		{"reaching into the text before", []protocol.TextEdit{edit(1, 1, 2, 1, "")}, "yz"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := target.apply(virtualText, test.edits); got != test.expected {
+				t.Errorf("Expected: %q, Got: %q", test.expected, got)
+			}
+		})
+	}
+}
@@ -7,10 +7,13 @@ package lsportal
 
 import (
 	contextpkg "context"
+	"errors"
 	"time"
 
+	"github.com/sourcegraph/jsonrpc2"
 	"github.com/tliron/commonlog"
 	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
 	"github.com/tliron/glsp/server"
 )
 
@@ -19,6 +22,15 @@ type ForwarderHandler struct {
 	// Base Protocol
 	Transformer Transformer
 	otherServer *server.Server
+	// The inclusion we forward to, for forwarders from the client
+	inclusion *Inclusion
+	// When several clients share the inclusion server, messages go to them instead of otherServer
+	clients *ClientSet
+	tracer  *Tracer
+	metrics *Metrics
+	spans   *SpanExporter
+	hops    traceHops
+	route   string
 }
 
 // Proves that ForwarderHandler implements glsp.Handler
@@ -32,37 +44,154 @@ func (self *ForwarderHandler) Handle(context *glsp.Context) (r any, validMethod
 	if context.Method == "exit" {
 		return nil, true, true, nil
 	}
+	var ranges []Range
+	if self.inclusion != nil {
+		ranges = self.inclusion.transformer.requestRanges(context)
+	}
+	received := time.Now()
+	id := ""
+	if self.tracer != nil || self.spans != nil {
+		id = nextMessageID()
+	}
+	requestID := requestIDOf(context.Context)
+	kind := "request"
+	if context.Notification {
+		kind = "notification"
+	}
+	var handleSpan *span
+	context.Context, handleSpan = self.spans.startRoot(context.Context, context.Method, spanServer)
+	handleSpan.set("rpc.system", "jsonrpc")
+	handleSpan.set("rpc.method", context.Method)
+	handleSpan.set("lsportal.id", id)
+	if requestID != "" {
+		handleSpan.set("rpc.jsonrpc.request_id", requestID)
+	}
+	handleSpan.set("lsportal.from", self.hops.from())
+	handleSpan.set("lsportal.route", self.route)
+	// Whichever way a request is answered, the answer is traced and measured.
+	// Notifications aren't answered so they have no latency
+	var transformed, inner time.Duration
+	defer func() {
+		handleSpan.end(err)
+		if context.Notification {
+			return
+		}
+		self.metrics.request(self.hops.from(), context.Method, self.route, transformed, inner)
+		self.tracer.response(self.hops.responseOut, id, requestID, context.Method, self.route, r, err, received)
+	}()
+	self.tracer.message(self.hops.in, id, requestID, kind, context.Method, self.route, context.Params)
+	self.metrics.message(self.hops.from(), kind, context.Method, self.route)
+	supervisor := self.supervisor()
+	if supervisor != nil {
+		supervisor.waitWhileStarting()
+	}
+	if len(ranges) > 1 {
+		r, transformed, inner, err = self.splitRangeRequest(context, id, ranges)
+		return r, true, true, err
+	}
 	//forward to transformer+
-	self.Transformer.TransformRequest(context)
-	res, err := self.forwardMessage(context)
+	transformStart := time.Now()
+	ctx := context.Context
+	// The transform steps hang their own spans off this one
+	var transformSpan *span
+	context.Context, transformSpan = startSpan(ctx, "transform request", spanInternal)
+	requestErr := self.Transformer.TransformRequest(context)
+	transformSpan.end(requestErr)
+	context.Context = ctx
+	transformed = time.Since(transformStart)
+	// Requests we refuse to forward get the reason back, other transform errors are only logged along the way
+	var rejected *rejectedError
+	if errors.As(requestErr, &rejected) && !context.Notification {
+		handleSpan.set("lsportal.rejected", true)
+		if rejected.result != nil {
+			return rejected.result, true, true, nil
+		}
+		return nil, true, true, requestErr
+	}
+	if supervisor != nil {
+		if r, handled := supervisor.standby(context); handled {
+			handleSpan.set("lsportal.standby", true)
+			return r, true, true, nil
+		}
+	}
+	if isFormattingMethod(context.Method) && self.inclusion != nil {
+		r, inner, err = self.formatInclusions(context, id)
+		return r, true, true, err
+	}
+	self.tracer.message(self.hops.out, id, "", kind, context.Method, self.route, context.Params)
+	sent := time.Now()
+	_, forwardSpan := startSpan(context.Context, "forward "+context.Method, spanClient)
+	if id != "" && !context.Notification {
+		forwardSpan.set("rpc.jsonrpc.request_id", "lsportal-"+id)
+	}
+	res, err := self.forwardMessage(context, id)
+	forwardSpan.end(err)
+	inner = time.Since(sent)
 	if err != nil {
+		self.tracer.response(self.hops.responseIn, id, "", context.Method, self.route, nil, err, sent)
 		self.logger.Errorf("error forwarding message: %v", err)
 		return nil, true, true, err
 	}
+	if context.Notification {
+		return nil, true, true, nil
+	}
+	self.tracer.response(self.hops.responseIn, id, "", context.Method, self.route, *res, nil, sent)
 
 	//this means we sent a request with a response
 	if *res != nil {
-		self.Transformer.TransformResponse(res)
+		transformStart = time.Now()
+		_, transformSpan = startSpan(context.Context, "transform response", spanInternal)
+		responseErr := self.Transformer.TransformResponse(context, res)
+		transformSpan.end(responseErr)
+		transformed += time.Since(transformStart)
+		if responseErr != nil {
+			return nil, true, true, responseErr
+		}
 		//TODO: return proper params and method validation
-		return res, true, true, nil
+		return *res, true, true, nil
 	}
 	return nil, true, true, nil
 
 }
 
-func (self *ForwarderHandler) forwardMessage(context *glsp.Context) (*any, error) {
+// id is the trace id, when tracing it becomes the JSON-RPC id of forwarded requests so both sides can be matched up
+func (self *ForwarderHandler) forwardMessage(context *glsp.Context, id string) (*any, error) {
 
 	var res any
-	var err error
-	ctx, cancel := contextpkg.WithTimeout(context.Context, 2*time.Second)
+	timeout := 2 * time.Second
+	if context.Method == MethodInitialize {
+		timeout = initializeTimeout
+	}
+	ctx, cancel := contextpkg.WithTimeout(context.Context, timeout)
 	defer cancel()
+	if self.clients != nil {
+		return self.clients.forward(ctx, context)
+	}
+	supervisor := self.supervisor()
+	if supervisor != nil && context.Notification && supervisor.hold(context.Method, context.Params) {
+		return &res, nil
+	}
+	connection, err := self.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Held notifications go after initialize, like they would have if the server had been there
+	if supervisor != nil && context.Method != MethodInitialize {
+		if err := supervisor.sendHeld(ctx, connection); err != nil {
+			return nil, err
+		}
+	}
 	if context.Notification {
 
-		err = self.otherServer.Connection.Notify(ctx, context.Method, context.Params)
+		err = connection.Notify(ctx, context.Method, context.Params)
 		res = nil
 
 	} else {
-		err = self.otherServer.Connection.Call(ctx, context.Method, context.Params, &res)
+		var options []jsonrpc2.CallOption
+		if id != "" {
+			options = append(options, jsonrpc2.PickID(jsonrpc2.ID{Str: "lsportal-" + id, IsString: true}))
+		}
+		err = connection.Call(ctx, context.Method, context.Params, &res, options...)
 	}
 	if err != nil {
 		return nil, err
@@ -71,3 +200,18 @@ func (self *ForwarderHandler) forwardMessage(context *glsp.Context) (*any, error
 
 	return &res, err
 }
+
+// The inclusion server may only be started once the client initializes, so wait for it to be connected
+func (self *ForwarderHandler) connection(ctx contextpkg.Context) (*jsonrpc2.Conn, error) {
+	if supervisor := self.supervisor(); supervisor != nil {
+		return supervisor.awaitConnection(ctx)
+	}
+	return waitForConnection(ctx, self.otherServer)
+}
+
+func (self *ForwarderHandler) supervisor() *Supervisor {
+	if self.inclusion == nil {
+		return nil
+	}
+	return self.inclusion.supervisor
+}
@@ -2,30 +2,68 @@ package lsportal
 
 import (
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 
 	protocol "github.com/tliron/glsp/protocol_3_16"
 )
 
+// Describes how to build the virtual document the inclusion server sees from a host document
+type Isolation struct {
+	// A multiline regex whose capture groups match the text you want to keep.
+	// If the regex has named groups only those are used, so unnamed groups can be used for structure
+	Regex string
+	// A multiline regex that should match text you want removed from within an inclusion
+	ExclusionRegex string
+	// Text injected around every inclusion so partial snippets still parse, eg: "SELECT * FROM t " for a WHERE clause.
+	// The injected text only exists in the virtual document, so positions inside it can't be mapped back to the client
+	Prefix string
+	Suffix string
+	// Token that replaces exclusions within an inclusion instead of blanking them, eg: "__X__", so the inner language still parses.
+	// The placeholder is opaque, positions inside it can't be mapped and edits touching it are dropped
+	Placeholder string
+	// Repeat the placeholder to the length of the exclusion so the rest of the line keeps its positions
+	PlaceholderSameLength bool
+	// Only use the named groups in this list, eg: when each named group goes to a different inclusion server
+	Groups []string
+	// Ignore the named groups in this list
+	SkipGroups []string
+}
+
+// The result of isolating the inclusions within a host document
+type isolatedText struct {
+	// The virtual document to send to the inclusion server
+	Text string
+	// The inclusions in host document positions
+	Inclusions []protocol.Range
+	SourceMap  SourceMap
+}
+
 // Process the text of the forwarder to replace anything except newlines not within the regexs with a space
 // inclusionRegex: A multiline regex that should match the text you want to keep within its first match group, it is expected to match many times
 // exclusionRegex: A multiline regex that should match text you want remove from within an inclusion
 // returns the new text and a slice of ranges for the inclusions
 func whitespaceExceptInclusions(text string, inclusionRegex string, exclusionRegex string) (string, []protocol.Range) {
+	isolated := isolateInclusions(text, Isolation{Regex: inclusionRegex, ExclusionRegex: exclusionRegex})
+	return isolated.Text, isolated.Inclusions
+}
+
+// Builds the virtual document for the text, blanking everything outside of inclusions, wrapping each inclusion in the
+// prefix and suffix and blanking or substituting exclusions
+func isolateInclusions(text string, isolation Isolation) isolatedText {
 	// Compile the inclusion regex
-	incRegex := regexp.MustCompile(inclusionRegex)
+	incRegex := regexp.MustCompile(isolation.Regex)
 
 	// Convert the text to a rune slice
 	runes := []rune(text)
 
 	// Create a slice to store the result
 	result := make([]rune, len(runes))
-	var lineEnds []int
+	lineEnds := findLineEnds(runes)
 	// Initialize the result slice with spaces
 	for i := range result {
 		if runes[i] == '\n' {
-			lineEnds = append(lineEnds, i)
 			result[i] = '\n'
 		} else {
 			result[i] = ' '
@@ -33,38 +71,184 @@ func whitespaceExceptInclusions(text string, inclusionRegex string, exclusionReg
 	}
 
 	var ranges []protocol.Range
+	var spans [][2]int
+	groups := isolation.inclusionGroups(incRegex)
+	lastEnd := 0
 	// Find all matches of the inclusion regex
 	matches := incRegex.FindAllStringSubmatchIndex(text, -1)
 	// Iterate over the matches
 	for _, match := range matches {
-		// Check if there is a capturing group
-		if len(match) >= 4 {
-			start, end := match[2], match[3]
+		// Every capture group that participated in the match is an inclusion
+		for _, group := range groups {
+			if match[2*group] < 0 {
+				continue
+			}
+			offsets := runeOffsets(text, match[2*group], match[2*group+1])
+			start, end := offsets[0], offsets[1]
+			// Groups nested within an inclusion we already have are part of it
+			if start < lastEnd {
+				continue
+			}
+			lastEnd = end
 			ranges = append(ranges, getRange(start, end, lineEnds))
+			spans = append(spans, [2]int{start, end})
 
 			// Copy the captured text to the result slice
 			copy(result[start:end], runes[start:end])
 		}
 	}
 
-	// Convert the result slice back to a string
-	processedText := string(result)
-
-	// Compile the exclusion regex if provided
-	if exclusionRegex != "" {
-		excRegex := regexp.MustCompile(exclusionRegex)
-		// Replace any matches of the exclusion regex with spaces
-		processedText = excRegex.ReplaceAllStringFunc(processedText, func(match string) string {
-			return strings.Map(func(r rune) rune {
-				if r == '\n' {
-					return '\n'
-				}
-				return ' '
-			}, match)
+	// Replace any matches of the exclusion regex with spaces, remembering the ones that need a placeholder
+	var exclusions [][2]int
+	if isolation.ExclusionRegex != "" {
+		excRegex := regexp.MustCompile(isolation.ExclusionRegex)
+		processedText := string(result)
+		for _, match := range excRegex.FindAllStringIndex(processedText, -1) {
+			offsets := runeOffsets(processedText, match[0], match[1])
+			start, end := offsets[0], offsets[1]
+			copy(result[start:end], []rune(blankOut(string(result[start:end]))))
+			if isolation.Placeholder != "" && start < end && withinSpan(spans, start, end) {
+				exclusions = append(exclusions, [2]int{start, end})
+			}
+		}
+	}
+
+	virtualText, sourceMap := assembleVirtual(result, spans, exclusions, isolation)
+	sourceMap.hostLineEnds = lineEnds
+	sourceMap.hostLength = len(runes)
+	return isolatedText{
+		Text:       virtualText,
+		Inclusions: ranges,
+		SourceMap:  sourceMap,
+	}
+}
+
+// Finds the indexes of the capture groups that should become inclusions
+func (isolation Isolation) inclusionGroups(regex *regexp.Regexp) []int {
+	names := regex.SubexpNames()
+	named := false
+	for _, name := range names {
+		if name != "" {
+			named = true
+		}
+	}
+	var groups []int
+	for i, name := range names {
+		if i == 0 || (named && name == "") {
+			continue
+		}
+		if len(isolation.Groups) > 0 && !slices.Contains(isolation.Groups, name) {
+			continue
+		}
+		if slices.Contains(isolation.SkipGroups, name) {
+			continue
+		}
+		groups = append(groups, i)
+	}
+	return groups
+}
+
+func withinSpan(spans [][2]int, start int, end int) bool {
+	for _, span := range spans {
+		if start >= span[0] && end <= span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces everything except newlines with a space
+func blankOut(match string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return '\n'
+		}
+		return ' '
+	}, match)
+}
+
+// Wraps each inclusion span of the blanked text in the prefix and suffix, swaps exclusions for their placeholder
+// and records where everything ended up
+func assembleVirtual(blanked []rune, spans [][2]int, exclusions [][2]int, isolation Isolation) (string, SourceMap) {
+	var builder strings.Builder
+	var segments []mapSegment
+	hostOffset, virtualOffset := 0, 0
+
+	copyHost := func(end int, inclusion bool) {
+		builder.WriteString(string(blanked[hostOffset:end]))
+		length := end - hostOffset
+		segments = append(segments, mapSegment{
+			kind:      segmentMapped,
+			hostStart: hostOffset, hostEnd: end,
+			virtualStart: virtualOffset, virtualEnd: virtualOffset + length,
+			inclusion: inclusion,
+		})
+		hostOffset = end
+		virtualOffset += length
+	}
+	// Writes text to the virtual document in place of the host text up to end
+	replace := func(end int, text string, kind segmentKind) {
+		if text == "" && end == hostOffset {
+			return
+		}
+		builder.WriteString(text)
+		length := len([]rune(text))
+		segments = append(segments, mapSegment{
+			kind:      kind,
+			hostStart: hostOffset, hostEnd: end,
+			virtualStart: virtualOffset, virtualEnd: virtualOffset + length,
 		})
+		hostOffset = end
+		virtualOffset += length
 	}
 
-	return processedText, ranges
+	nextExclusion := 0
+	for _, span := range spans {
+		// Overlapping inclusions can't happen with a single regex, but be safe
+		if span[0] < hostOffset {
+			continue
+		}
+		copyHost(span[0], false)
+		replace(hostOffset, isolation.Prefix, segmentInjected)
+		for ; nextExclusion < len(exclusions) && exclusions[nextExclusion][1] <= span[1]; nextExclusion++ {
+			exclusion := exclusions[nextExclusion]
+			if exclusion[0] < hostOffset {
+				continue
+			}
+			copyHost(exclusion[0], true)
+			replace(exclusion[1], placeholderFor(blanked[exclusion[0]:exclusion[1]], isolation), segmentOpaque)
+		}
+		copyHost(span[1], true)
+		replace(hostOffset, isolation.Suffix, segmentInjected)
+	}
+	copyHost(len(blanked), false)
+
+	virtualText := builder.String()
+	virtualRunes := []rune(virtualText)
+	return virtualText, SourceMap{
+		segments:        segments,
+		virtualLineEnds: findLineEnds(virtualRunes),
+		virtualLength:   len(virtualRunes),
+	}
+}
+
+// The text an exclusion is replaced with, when keeping the same length newlines are kept so lines don't move either
+func placeholderFor(excluded []rune, isolation Isolation) string {
+	if !isolation.PlaceholderSameLength {
+		return isolation.Placeholder
+	}
+	token := []rune(isolation.Placeholder)
+	ret := make([]rune, len(excluded))
+	next := 0
+	for i, r := range excluded {
+		if r == '\n' {
+			ret[i] = '\n'
+			continue
+		}
+		ret[i] = token[next%len(token)]
+		next++
+	}
+	return string(ret)
 }
 
 func getPosition(offset int, lineEnds []int) protocol.Position {
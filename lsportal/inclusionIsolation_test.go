@@ -114,3 +114,106 @@ func TestGetOnlyInclusionsWithRanges(t *testing.T) {
 		})
 	}
 }
+
+func TestIsolateInclusionsWithPrefixAndSuffix(t *testing.T) {
+	text := "a ~id = 1~ b\n~x~"
+	isolated := isolateInclusions(text, Isolation{Regex: `~([\s\S]*?)~`, Prefix: "WHERE ", Suffix: ";"})
+
+	expected := "   WHERE id = 1;   \n WHERE x; "
+	if isolated.Text != expected {
+		t.Errorf("Expected: %q, Got: %q", expected, isolated.Text)
+	}
+	// Inclusions are still reported in host positions
+	expectedRanges := [][2]int{{3, 9}, {14, 15}}
+	for i, expectedRange := range expectedRanges {
+		start, end := isolated.Inclusions[i].IndexesIn([]byte(text))
+		if [2]int{start, end} != expectedRange {
+			t.Errorf("Expected range %d: %v, Got: %v", i, expectedRange, isolated.Inclusions[i])
+		}
+	}
+}
+
+func TestIsolateInclusionsWithPlaceholder(t *testing.T) {
+	text := `h(~<div class="{{.C}}">~)`
+	testCases := []struct {
+		name       string
+		sameLength bool
+		expected   string
+	}{
+		{name: "Token", expected: `   <div class="__X">  `},
+		{name: "Same length", sameLength: true, expected: `   <div class="__X__X">  `},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			isolated := isolateInclusions(text, Isolation{
+				Regex:                 `~([\s\S]*?)~`,
+				ExclusionRegex:        `{{[\s\S]*?}}`,
+				Placeholder:           "__X",
+				PlaceholderSameLength: tc.sameLength,
+			})
+			if isolated.Text != tc.expected {
+				t.Errorf("Expected: %q, Got: %q", tc.expected, isolated.Text)
+			}
+		})
+	}
+}
+
+func TestGetOnlyInclusionsWithGroups(t *testing.T) {
+	testCases := []struct {
+		name       string
+		text       string
+		isolation  Isolation
+		expected   string
+		inclusions int
+	}{
+		{
+			name:       "Alternation",
+			text:       "a(`x`) b(\"y\")",
+			isolation:  Isolation{Regex: "a\\(`(.*?)`\\)|b\\(\"(.*?)\"\\)"},
+			expected:   "   x      y  ",
+			inclusions: 2,
+		},
+		{
+			name:       "Nested groups are part of their parent",
+			text:       "~ab~",
+			isolation:  Isolation{Regex: `~((a)b)~`},
+			expected:   " ab ",
+			inclusions: 1,
+		},
+		{
+			name:       "Named groups ignore unnamed ones",
+			text:       "~ab~",
+			isolation:  Isolation{Regex: `~(a)(?P<body>b)~`},
+			expected:   "  b ",
+			inclusions: 1,
+		},
+		{
+			name:       "Only the selected group",
+			text:       "h(x) c(y)",
+			isolation:  Isolation{Regex: `h\((?P<html>.*?)\)|c\((?P<css>.*?)\)`, Groups: []string{"css"}},
+			expected:   "       y ",
+			inclusions: 1,
+		},
+		{
+			name:       "Skipped groups",
+			text:       "h(x) c(y)",
+			isolation:  Isolation{Regex: `h\((?P<html>.*?)\)|c\((?P<css>.*?)\)`, SkipGroups: []string{"css"}},
+			expected:   "  x      ",
+			inclusions: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			isolated := isolateInclusions(tc.text, tc.isolation)
+			validateChanges(t, tc.text, isolated.Text)
+
+			if isolated.Text != tc.expected {
+				t.Errorf("Expected: %q, Got: %q", tc.expected, isolated.Text)
+			}
+			if len(isolated.Inclusions) != tc.inclusions {
+				t.Errorf("Expected %d inclusions, Got %d", tc.inclusions, len(isolated.Inclusions))
+			}
+		})
+	}
+}
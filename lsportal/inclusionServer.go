@@ -1,13 +1,40 @@
 package lsportal
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tliron/commonlog"
 )
 
+// Options for starting the inclusion server process
+type ProcessOptions struct {
+	// Called with every line the server writes to stderr, on top of it being logged
+	OnStderr func(line string)
+	// The working directory, our own if empty
+	Dir string
+	// KEY=VALUE pairs added to the environment we pass on, replacing any we have ourselves
+	Env []string
+	// Directories put in front of PATH, relative ones are relative to Dir, eg: node_modules/.bin.
+	// The command is looked up in them first
+	PathPrepend []string
+}
+
 func StartLanguageServer(command string, args []string) (io.ReadWriteCloser, error) {
+	return StartLanguageServerWith(command, args, ProcessOptions{})
+}
+
+func StartLanguageServerWith(command string, args []string, options ProcessOptions) (io.ReadWriteCloser, error) {
 	// Create a new command instance
-	cmd := exec.Command(command, args...)
+	cmd := exec.Command(options.Resolve(command), args...)
+	cmd.Dir = options.Dir
+	cmd.Env = options.environ()
 
 	// Create pipes for stdin and stdout
 	stdin, err := cmd.StdinPipe()
@@ -20,10 +47,18 @@ func StartLanguageServer(command string, args []string) (io.ReadWriteCloser, err
 		return nil, err
 	}
 
+	// Without this anything the server says about failing to start disappears
+	stderr := &stderrLog{
+		logger: commonlog.GetLoggerf("stderr.%s", filepath.Base(command)),
+		onLine: options.OnStderr,
+	}
+	cmd.Stderr = stderr
+
 	// Create a custom ReadWriteCloser that combines stdin and stdout
 	rwc := &cmdReadWriteCloser{
 		stdin:  stdin,
 		stdout: stdout,
+		stderr: stderr,
 		cmd:    cmd,
 	}
 
@@ -37,10 +72,79 @@ func StartLanguageServer(command string, args []string) (io.ReadWriteCloser, err
 	return rwc, nil
 }
 
+// exec.Command only looks the command up in our own PATH, so look in the directories we prepend first.
+// Returns the command as is if it isn't in any of them
+func (options ProcessOptions) Resolve(command string) string {
+	if strings.ContainsRune(command, filepath.Separator) {
+		return command
+	}
+	for _, dir := range options.pathDirs() {
+		path := filepath.Join(dir, command)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path
+		}
+	}
+	return command
+}
+
+func (options ProcessOptions) pathDirs() []string {
+	var dirs []string
+	for _, dir := range options.PathPrepend {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(options.Dir, dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// Our environment with the options applied, nil to inherit it as is
+func (options ProcessOptions) environ() []string {
+	if len(options.Env) == 0 && len(options.PathPrepend) == 0 {
+		return nil
+	}
+	env := os.Environ()
+	for _, entry := range options.Env {
+		key, _, _ := strings.Cut(entry, "=")
+		env = setEnv(env, key, entry)
+	}
+	if dirs := options.pathDirs(); len(dirs) > 0 {
+		path := strings.Join(dirs, string(os.PathListSeparator))
+		if current := getEnv(env, "PATH"); current != "" {
+			path += string(os.PathListSeparator) + current
+		}
+		env = setEnv(env, "PATH", "PATH="+path)
+	}
+	return env
+}
+
+func setEnv(env []string, key string, entry string) []string {
+	for i, existing := range env {
+		if strings.HasPrefix(existing, key+"=") {
+			env[i] = entry
+			return env
+		}
+	}
+	return append(env, entry)
+}
+
+func getEnv(env []string, key string) string {
+	for _, existing := range env {
+		if value, ok := strings.CutPrefix(existing, key+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
 type cmdReadWriteCloser struct {
 	stdin  io.WriteCloser
 	stdout io.ReadCloser
+	stderr *stderrLog
 	cmd    *exec.Cmd
+	// jsonrpc2 closes the stream when the connection drops, we close it again once we are done with it
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func (rwc *cmdReadWriteCloser) Read(p []byte) (n int, err error) {
@@ -51,10 +155,78 @@ func (rwc *cmdReadWriteCloser) Write(p []byte) (n int, err error) {
 	return rwc.stdin.Write(p)
 }
 
+// Closes stdin and waits for the process to exit, if it failed the error includes the end of its stderr
 func (rwc *cmdReadWriteCloser) Close() error {
+	rwc.closeOnce.Do(func() {
+		rwc.closeErr = rwc.close()
+	})
+	return rwc.closeErr
+}
+
+func (rwc *cmdReadWriteCloser) close() error {
 	err := rwc.stdin.Close()
 	if err != nil {
 		return err
 	}
-	return rwc.cmd.Wait()
+	err = rwc.cmd.Wait()
+	if err != nil {
+		if tail := rwc.stderr.Tail(); tail != "" {
+			return fmt.Errorf("%v, stderr:\n%s", err, tail)
+		}
+	}
+	return err
+}
+
+// Kills the process, Close still has to be called to reap it
+func (rwc *cmdReadWriteCloser) Kill() error {
+	return rwc.cmd.Process.Kill()
+}
+
+// How many lines of stderr we keep to explain why a server exited
+const stderrTailLines = 20
+
+// Collects what the server writes to stderr, logging it line by line and keeping the last few lines around
+type stderrLog struct {
+	logger  commonlog.Logger
+	onLine  func(line string)
+	lock    sync.Mutex
+	partial []byte
+	tail    []string
+}
+
+func (self *stderrLog) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.partial = append(self.partial, p...)
+	for {
+		end := bytes.IndexByte(self.partial, '\n')
+		if end < 0 {
+			break
+		}
+		self.addLine(strings.TrimRight(string(self.partial[:end]), "\r"))
+		self.partial = self.partial[end+1:]
+	}
+	return len(p), nil
+}
+
+func (self *stderrLog) addLine(line string) {
+	self.logger.Info(line)
+	if self.onLine != nil {
+		self.onLine(line)
+	}
+	self.tail = append(self.tail, line)
+	if len(self.tail) > stderrTailLines {
+		self.tail = self.tail[1:]
+	}
+}
+
+// The last lines written to stderr, including any unfinished line
+func (self *stderrLog) Tail() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	lines := self.tail
+	if len(self.partial) > 0 {
+		lines = append(lines[:len(lines):len(lines)], string(self.partial))
+	}
+	return strings.Join(lines, "\n")
 }
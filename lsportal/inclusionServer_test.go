@@ -0,0 +1,78 @@
+package lsportal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tliron/commonlog"
+)
+
+func TestStderrIsInExitError(t *testing.T) {
+	var lines []string
+	readWrite, err := StartLanguageServerWith("sh", []string{"-c", "echo 'cannot find module' >&2; exit 3"}, ProcessOptions{
+		OnStderr: func(line string) { lines = append(lines, line) },
+	})
+	if err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	err = readWrite.Close()
+	if err == nil || !strings.Contains(err.Error(), "cannot find module") {
+		t.Errorf("Expected the exit error to include stderr, Got: %v", err)
+	}
+	if len(lines) != 1 || lines[0] != "cannot find module" {
+		t.Errorf("Expected stderr lines to be passed on, Got: %q", lines)
+	}
+}
+
+func TestStderrLogSplitsLines(t *testing.T) {
+	var lines []string
+	log := stderrLog{logger: commonlog.GetLogger("test"), onLine: func(line string) { lines = append(lines, line) }}
+	log.Write([]byte("first\r\nsec"))
+	log.Write([]byte("ond\nunfinished"))
+
+	if len(lines) != 2 || lines[0] != "first" || lines[1] != "second" {
+		t.Errorf("Expected lines split across writes, Got: %q", lines)
+	}
+	if tail := log.Tail(); tail != "first\nsecond\nunfinished" {
+		t.Errorf("Expected the tail to include the unfinished line, Got: %q", tail)
+	}
+}
+
+func TestProcessOptions(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "node_modules", ".bin")
+	os.MkdirAll(bin, 0755)
+	os.WriteFile(filepath.Join(bin, "fake-language-server"), []byte("#!/bin/sh\necho \"$GREETING $(pwd -P)\" >&2\n"), 0755)
+
+	var lines []string
+	readWrite, err := StartLanguageServerWith("fake-language-server", nil, ProcessOptions{
+		OnStderr:    func(line string) { lines = append(lines, line) },
+		Dir:         dir,
+		Env:         []string{"GREETING=hello"},
+		PathPrepend: []string{"node_modules/.bin"},
+	})
+	if err != nil {
+		t.Fatalf("Expected the server to be found in the prepended path: %v", err)
+	}
+	readWrite.Close()
+	realDir, _ := filepath.EvalSymlinks(dir)
+	if len(lines) != 1 || lines[0] != "hello "+realDir {
+		t.Errorf("Expected the server to run in %s with our env, Got: %q", realDir, lines)
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "node_modules", ".bin")
+	os.MkdirAll(bin, 0755)
+	os.WriteFile(filepath.Join(bin, "fake-language-server"), []byte("#!/bin/sh\n"), 0755)
+	options := ProcessOptions{Dir: dir, PathPrepend: []string{"node_modules/.bin"}}
+	if resolved := options.Resolve("fake-language-server"); resolved != filepath.Join(bin, "fake-language-server") {
+		t.Errorf("Expected the server in the prepended path, Got: %s", resolved)
+	}
+	if resolved := options.Resolve("fake-langauge-server"); resolved != "fake-langauge-server" {
+		t.Errorf("Expected a command that isn't there to stay as is, Got: %s", resolved)
+	}
+}
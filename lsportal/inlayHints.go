@@ -0,0 +1,126 @@
+package lsportal
+
+// Inlay hints come back with a position, label parts that may point at locations and edits that insert the hint, all
+// of which have to move into the host. Hints outside the inclusions are dropped, and so are edits that would change
+// host code.
+// inlayHint/resolve only carries the hint, so the hints we hand out remember their document and route in their data.
+// The router sends the resolve to that route alone, and before the inner server resolves the hint its own data is put
+// back and the document is named in a textDocument field it ignores.
+
+import (
+	"encoding/json"
+
+	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
+)
+
+// Not part of 3.16
+const (
+	MethodInlayHintResolve          = Method("inlayHint/resolve")
+	MethodWorkspaceInlayHintRefresh = Method("workspace/inlayHint/refresh")
+)
+
+// Moves the inlay hints of an inlayHint response into the host document, call with the lock held
+func (trans *FromClientTransformer) transformInlayHints(context *glsp.Context, response *any) {
+	hints, ok := (*response).([]any)
+	if !ok {
+		*response = nil
+		return
+	}
+	hostUri := trans.UriMap[requestUri(context)]
+	kept := []any{}
+	for _, hint := range hints {
+		if hint, ok := trans.transformInlayHint(hostUri, hint); ok {
+			kept = append(kept, hint)
+		}
+	}
+	*response = kept
+}
+
+// Moves an inlay hint of the virtual document into the host document, false if it is outside the inclusions
+func (trans *FromClientTransformer) transformInlayHint(hostUri string, hint any) (any, bool) {
+	doc, ok := trans.Documents[hostUri]
+	if !ok {
+		return hint, false
+	}
+	moved, ok := trans.toHost().walk(hint, &doc.SourceMap)
+	object, isObject := moved.(map[string]any)
+	if !ok || !isObject {
+		return hint, false
+	}
+	// An echo of the document we named when resolving
+	delete(object, "textDocument")
+	position, ok := object["position"].(map[string]any)
+	if !ok {
+		return hint, false
+	}
+	if at, ok := asPosition(position); !ok || doc.inclusionOf(Range{Start: at, End: at}) < 0 {
+		return hint, false
+	}
+	if edits, ok := object["textEdits"].([]any); ok {
+		kept := []any{}
+		for _, edit := range edits {
+			edit, _ := edit.(map[string]any)
+			if r, ok := asRange(edit["range"]); ok && doc.inclusionOf(r) >= 0 {
+				kept = append(kept, edit)
+			}
+		}
+		object["textEdits"] = kept
+	}
+	trans.tag(object, hostUri)
+	return object, true
+}
+
+// Wraps the data of something we hand out to be resolved later with the host document and our route
+func (trans *FromClientTransformer) tag(object map[string]any, hostUri string) {
+	data := map[string]any{"lsportalUri": hostUri, "lsportalRoute": trans.route}
+	if inner, ok := object["data"]; ok {
+		data["data"] = inner
+	}
+	object["data"] = data
+}
+
+// Puts back the data of the inner server in the params of a resolve request, returning the host document it is about
+func untag(params map[string]any) (string, bool) {
+	data, _ := params["data"].(map[string]any)
+	uri, ok := data["lsportalUri"].(string)
+	if !ok {
+		return "", false
+	}
+	if inner, ok := data["data"]; ok && inner != nil {
+		params["data"] = inner
+	} else {
+		delete(params, "data")
+	}
+	return uri, true
+}
+
+// The route the params of a resolve request were handed out by, see [FromClientTransformer.tag]
+func taggedRoute(params json.RawMessage) (string, bool) {
+	var tagged struct {
+		Data struct {
+			Route *string `json:"lsportalRoute"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(params, &tagged) != nil || tagged.Data.Route == nil {
+		return "", false
+	}
+	return *tagged.Data.Route, true
+}
+
+// Puts back the data of the inner server in the hint of an inlayHint/resolve request and names its document, so it
+// can be moved like any request about a document
+func (trans *FromClientTransformer) unwrapInlayHint(context *glsp.Context) error {
+	err := runParamsTransform(context, func(params *map[string]any) error {
+		uri, ok := untag(*params)
+		if !ok {
+			return reject("Can't resolve an inlay hint lsportal didn't hand out")
+		}
+		(*params)["textDocument"] = map[string]any{"uri": uri}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return trans.transformDocumentRequest(context)
+}
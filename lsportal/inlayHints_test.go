@@ -0,0 +1,77 @@
+package lsportal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestTransformInlayHints(t *testing.T) {
+	trans := NewFromClientTransformer("htmlT\\(`([\\s\\S]*?)`\\)", "", "html")
+	trans.Prefix = "<p>"
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x := 1\na := htmlT(` + "`" + `<b>x</b>` + "`" + `)"}}`),
+	})
+	tests := []struct {
+		name     string
+		hint     string
+		expected string
+	}{
+		{
+			name:     "hints move to the host and remember their document",
+			hint:     `{"position": {"line": 1, "character": 18}, "label": [{"value": "b", "location": {"uri": "file:///a.html", "range": {"start": {"line": 1, "character": 15}, "end": {"line": 1, "character": 18}}}}], "data": 7}`,
+			expected: `[{"data":{"data":7,"lsportalRoute":"","lsportalUri":"file:///a.go"},"label":[{"location":{"range":{"end":{"character":15,"line":1},"start":{"character":12,"line":1}},"uri":"file:///a.go"},"value":"b"}],"position":{"character":15,"line":1}}]`,
+		},
+		{
+			name:     "hints outside of the inclusions are dropped",
+			hint:     `{"position": {"line": 0, "character": 1}, "label": "int"}`,
+			expected: `[]`,
+		},
+		{
+			name:     "edits outside of the inclusions are dropped",
+			hint:     `{"position": {"line": 1, "character": 18}, "label": "x", "textEdits": [{"range": {"start": {"line": 1, "character": 18}, "end": {"line": 1, "character": 18}}, "newText": "x"}, {"range": {"start": {"line": 0, "character": 0}, "end": {"line": 0, "character": 0}}, "newText": "x"}]}`,
+			expected: `[{"data":{"lsportalRoute":"","lsportalUri":"file:///a.go"},"label":"x","position":{"character":15,"line":1},"textEdits":[{"newText":"x","range":{"end":{"character":15,"line":1},"start":{"character":15,"line":1}}}]}]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response any
+			json.Unmarshal([]byte("["+test.hint+"]"), &response)
+			trans.TransformResponse(&glsp.Context{Method: MethodTextDocumentInlayHint, Params: []byte(`{"textDocument": {"uri": "file:///a.html"}}`)}, &response)
+			if got, _ := json.Marshal(response); string(got) != test.expected {
+				t.Errorf("Expected: %s, Got: %s", test.expected, got)
+			}
+		})
+	}
+
+	context := &glsp.Context{Method: MethodInlayHintResolve, Params: []byte(`{"position": {"line": 1, "character": 15}, "label": "b", "data": {"lsportalUri": "file:///a.go", "data": 7}}`)}
+	if err := trans.TransformRequest(context); err != nil {
+		t.Fatalf("Failed to transform the resolve request: %v", err)
+	}
+	if expected := `{"data":7,"label":"b","position":{"character":18,"line":1},"textDocument":{"uri":"file:///a.html"}}`; string(context.Params) != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, context.Params)
+	}
+	var resolved any
+	json.Unmarshal([]byte(`{"position": {"line": 1, "character": 18}, "label": "b", "tooltip": "bold", "data": 7}`), &resolved)
+	if err := trans.TransformResponse(context, &resolved); err != nil {
+		t.Fatalf("Failed to transform the resolved hint: %v", err)
+	}
+	if got, _ := json.Marshal(resolved); string(got) != `{"data":{"data":7,"lsportalRoute":"","lsportalUri":"file:///a.go"},"label":"b","position":{"character":15,"line":1},"tooltip":"bold"}` {
+		t.Errorf("Expected the resolved hint in the host, Got: %s", got)
+	}
+}
+
+func TestInlayHintRefresh(t *testing.T) {
+	fromClient, _, server := serveRoute(t, Route{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"})
+	client := connectClient(t, fromClient)
+
+	if err := server.Call(MethodWorkspaceInlayHintRefresh, nil, nil); err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+	if _, err := client.WaitFor(MethodWorkspaceInlayHintRefresh); err != nil {
+		t.Errorf("Expected the client to be asked to refresh: %v", err)
+	}
+}
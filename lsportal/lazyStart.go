@@ -0,0 +1,317 @@
+package lsportal
+
+// A lazy supervisor only starts its server once a document with an inclusion is open.
+// Until then we answer initialize ourselves with nothing but document sync, so the client tells us about its documents
+// without us making up what the server can do. The transformer tracks the documents and the replay brings the server up
+// to date once it starts, after which its real capabilities are registered with the client dynamically.
+// With an idle timeout the server is stopped again once no inclusions have been open for that long.
+
+import (
+	contextpkg "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
+)
+
+type lazyState int
+
+const (
+	lazyIdle lazyState = iota
+	// The server is being started and replayed, messages wait for it so it sees initialize first
+	lazyStarting
+	lazyRunning
+)
+
+// What we tell the client before the server is running, enough to hear about the documents that will start it
+var lazyCapabilities = map[string]any{
+	"textDocumentSync": map[string]any{
+		"openClose": true,
+		"change":    TextDocumentSyncKindIncremental,
+	},
+}
+
+// The server capabilities a client can register dynamically, with the method they are registered for and where the
+// client says it supports that
+var dynamicCapabilities = []struct {
+	provider string
+	method   Method
+	client   string
+}{
+	{"hoverProvider", MethodTextDocumentHover, "textDocument.hover"},
+	{"completionProvider", MethodTextDocumentCompletion, "textDocument.completion"},
+	{"signatureHelpProvider", MethodTextDocumentSignatureHelp, "textDocument.signatureHelp"},
+	{"declarationProvider", MethodTextDocumentDeclaration, "textDocument.declaration"},
+	{"definitionProvider", MethodTextDocumentDefinition, "textDocument.definition"},
+	{"typeDefinitionProvider", MethodTextDocumentTypeDefinition, "textDocument.typeDefinition"},
+	{"implementationProvider", MethodTextDocumentImplementation, "textDocument.implementation"},
+	{"referencesProvider", MethodTextDocumentReferences, "textDocument.references"},
+	{"documentHighlightProvider", MethodTextDocumentDocumentHighlight, "textDocument.documentHighlight"},
+	{"documentSymbolProvider", MethodTextDocumentDocumentSymbol, "textDocument.documentSymbol"},
+	{"codeActionProvider", MethodTextDocumentCodeAction, "textDocument.codeAction"},
+	{"codeLensProvider", MethodTextDocumentCodeLens, "textDocument.codeLens"},
+	{"documentLinkProvider", MethodTextDocumentDocumentLink, "textDocument.documentLink"},
+	{"colorProvider", MethodTextDocumentColor, "textDocument.colorProvider"},
+	{"documentFormattingProvider", MethodTextDocumentFormatting, "textDocument.formatting"},
+	{"documentRangeFormattingProvider", MethodTextDocumentRangeFormatting, "textDocument.rangeFormatting"},
+	{"documentOnTypeFormattingProvider", MethodTextDocumentOnTypeFormatting, "textDocument.onTypeFormatting"},
+	{"renameProvider", MethodTextDocumentRename, "textDocument.rename"},
+	{"foldingRangeProvider", MethodTextDocumentFoldingRange, "textDocument.foldingRange"},
+	{"selectionRangeProvider", MethodTextDocumentSelectionRange, "textDocument.selectionRange"},
+	{"linkedEditingRangeProvider", MethodTextDocumentLinkedEditingRange, "textDocument.linkedEditingRange"},
+	{"callHierarchyProvider", MethodTextDocumentPrepareCallHierarchy, "textDocument.callHierarchy"},
+	{"semanticTokensProvider", Method("textDocument/semanticTokens"), "textDocument.semanticTokens"},
+	{"monikerProvider", MethodTextDocumentMoniker, "textDocument.moniker"},
+	{"inlayHintProvider", MethodTextDocumentInlayHint, "textDocument.inlayHint"},
+	{"executeCommandProvider", MethodWorkspaceExecuteCommand, "workspace.executeCommand"},
+	{"workspaceSymbolProvider", MethodWorkspaceSymbol, "workspace.symbol"},
+}
+
+// Holds messages back while a lazy server is starting, call before the transformer sees the message
+func (self *Supervisor) waitWhileStarting() {
+	if !self.Lazy {
+		return
+	}
+	self.lock.Lock()
+	state, ready := self.lazyState, self.ready
+	self.lock.Unlock()
+	if state != lazyStarting {
+		return
+	}
+	select {
+	case <-ready:
+	case <-time.After(self.StartupPeriod):
+		self.logger.Warningf("%s is taking too long to start", self.Command)
+	}
+}
+
+// Stands in for a lazy server that isn't running, returns true if it took care of the message.
+// Call after the transformer saw the message, so the documents are up to date for the replay
+func (self *Supervisor) standby(context *glsp.Context) (any, bool) {
+	if !self.Lazy {
+		return nil, false
+	}
+	self.lock.Lock()
+	if self.lazyState != lazyIdle {
+		self.lock.Unlock()
+		return nil, false
+	}
+	if context.Method == MethodInitialize {
+		self.lock.Unlock()
+		return map[string]any{"capabilities": lazyCapabilities}, true
+	}
+	if !self.inclusion.transformer.hasInclusions() {
+		// Nothing the server could help with yet, the replay catches it up on the documents
+		self.lock.Unlock()
+		return nil, true
+	}
+	// Starting from here keeps every message after this one waiting for the replay
+	self.lazyState = lazyStarting
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+	self.lock.Unlock()
+	if context.Notification {
+		// The replay brings the documents and the configuration along
+		return nil, true
+	}
+	self.waitWhileStarting()
+	return nil, false
+}
+
+// Blocks a lazy supervisor until standby wakes it, returns false if we were stopped instead
+func (self *Supervisor) waitForInclusions() bool {
+	for {
+		self.lock.Lock()
+		state := self.lazyState
+		self.lock.Unlock()
+		if state != lazyIdle {
+			return true
+		}
+		select {
+		case <-self.wake:
+		case <-self.stopping:
+			return false
+		}
+	}
+}
+
+// The server is up to date, let waiting messages through
+func (self *Supervisor) markReady() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.lazyState == lazyStarting {
+		self.lazyState = lazyRunning
+		close(self.ready)
+	}
+}
+
+// The server is gone, a lazy one restarts right away if it still has inclusions to work on.
+// If it was still starting the messages keep waiting for the next replay
+func (self *Supervisor) markExited() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.lazyState != lazyRunning {
+		return
+	}
+	self.ready = make(chan struct{})
+	if self.inclusion.transformer.hasInclusions() {
+		self.lazyState = lazyStarting
+	} else {
+		self.lazyState = lazyIdle
+	}
+}
+
+// Returns true once if the server exited because we stopped it for being idle
+func (self *Supervisor) takeIdled() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	idled := self.idled
+	self.idled = false
+	return idled
+}
+
+// Stops the server once no inclusions have been open for IdleTimeout, until exited is closed
+func (self *Supervisor) watchIdle(readWrite io.ReadWriteCloser, exited <-chan struct{}) {
+	interval := max(self.IdleTimeout/10, 10*time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var idleSince time.Time
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+		if self.inclusion.transformer.hasInclusions() {
+			idleSince = time.Time{}
+			continue
+		}
+		if idleSince.IsZero() {
+			idleSince = time.Now()
+			continue
+		}
+		if time.Since(idleSince) >= self.IdleTimeout {
+			self.stopIdle(readWrite, exited)
+			return
+		}
+	}
+}
+
+func (self *Supervisor) stopIdle(readWrite io.ReadWriteCloser, exited <-chan struct{}) {
+	self.lock.Lock()
+	if self.lazyState == lazyRunning {
+		self.ready = make(chan struct{})
+	}
+	self.lazyState = lazyIdle
+	self.idled = true
+	self.lock.Unlock()
+	self.logger.Infof("no inclusions open for %s, stopping %s", self.IdleTimeout, self.Command)
+
+	if connection := connectionOf(self.inclusion.Server); connection != nil {
+		ctx, cancel := contextpkg.WithTimeout(contextpkg.Background(), self.StartupPeriod)
+		var result any
+		if err := connection.Call(ctx, MethodShutdown, nil, &result); err != nil {
+			self.logger.Warningf("error shutting down idle %s: %v", self.Command, err)
+		}
+		connection.Notify(ctx, MethodExit, nil)
+		cancel()
+	}
+	select {
+	case <-exited:
+	case <-time.After(self.StartupPeriod):
+		self.logger.Warningf("idle %s didn't exit, killing it", self.Command)
+		terminate(readWrite)
+	}
+}
+
+// Tells the client what a lazily started server can do, from the result of the replayed initialize. Only once, and only
+// what the client can register dynamically and wasn't told about when it initialized
+func (self *Supervisor) registerCapabilities(initializeResult any) {
+	self.lock.Lock()
+	registered := self.registered
+	self.registered = true
+	self.lock.Unlock()
+	if registered {
+		return
+	}
+	if err := self.inclusion.transformer.TransformResponse(&glsp.Context{Method: MethodInitialize, Context: contextpkg.Background()}, &initializeResult); err != nil {
+		self.logger.Errorf("error translating the capabilities of %s: %v", self.Command, err)
+		return
+	}
+	var server, client struct {
+		Capabilities map[string]any `json:"capabilities"`
+	}
+	remarshal(initializeResult, &server)
+	json.Unmarshal(self.inclusion.transformer.replayState().initialize, &client)
+
+	registrations := []Registration{}
+	for _, capability := range dynamicCapabilities {
+		provider, ok := server.Capabilities[capability.provider]
+		if !ok || provider == nil || provider == false || !dynamicRegistration(client.Capabilities, capability.client) || self.inclusion.router.announced(capability.provider) {
+			continue
+		}
+		options, _ := provider.(map[string]any)
+		if options == nil {
+			options = map[string]any{}
+		}
+		if strings.HasPrefix(capability.method, "textDocument/") {
+			// null leaves it to the client, which only sends us the documents it has us for anyway
+			options["documentSelector"] = nil
+		}
+		registrations = append(registrations, Registration{
+			ID:              fmt.Sprintf("lsportal.%s.%s", self.inclusion.Route.Name, capability.method),
+			Method:          capability.method,
+			RegisterOptions: options,
+		})
+	}
+	if len(registrations) == 0 {
+		return
+	}
+	params, _ := json.Marshal(RegistrationParams{Registrations: registrations})
+	// In a shared session this reaches the first client, see [ClientSet]
+	if _, err := self.inclusion.toClient.forwardMessage(&glsp.Context{Method: ServerClientRegisterCapability, Params: params, Context: contextpkg.Background()}, ""); err != nil {
+		self.logger.Errorf("error registering the capabilities of %s: %v", self.Command, err)
+	}
+}
+
+// Whether the client capabilities say the client can register the capability at path, eg: textDocument.hover
+func dynamicRegistration(capabilities map[string]any, path string) bool {
+	current := capabilities
+	for _, key := range strings.Split(path, ".") {
+		next, ok := current[key].(map[string]any)
+		if !ok {
+			return false
+		}
+		current = next
+	}
+	supported, _ := current["dynamicRegistration"].(bool)
+	return supported
+}
+
+// Remembers the capabilities the client was told about when it initialized
+func (self *RouterHandler) announce(result any) {
+	var initializeResult struct {
+		Capabilities map[string]any `json:"capabilities"`
+	}
+	remarshal(derefResult(result), &initializeResult)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.capabilities = initializeResult.Capabilities
+}
+
+// Whether the client was told about the capability when it initialized, registering it again would ask twice
+func (self *RouterHandler) announced(capability string) bool {
+	if self == nil {
+		return false
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	provider, ok := self.capabilities[capability]
+	return ok && provider != nil && provider != false
+}
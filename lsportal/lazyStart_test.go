@@ -0,0 +1,138 @@
+package lsportal
+
+import (
+	contextpkg "context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+// A language server daemon that remembers every method it was sent
+type recordingServer struct {
+	lock        sync.Mutex
+	connections int
+	methods     []string
+	// How long initialize takes to answer
+	initializeDelay time.Duration
+}
+
+func (self *recordingServer) listen(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			self.lock.Lock()
+			self.connections++
+			self.lock.Unlock()
+			newTestConn(conn, func(_ *jsonrpc2.Conn, req *jsonrpc2.Request) any {
+				self.lock.Lock()
+				self.methods = append(self.methods, req.Method)
+				self.lock.Unlock()
+				if req.Method == protocol.MethodInitialize {
+					time.Sleep(self.initializeDelay)
+				}
+				return map[string]any{"capabilities": map[string]any{"hoverProvider": true, "colorProvider": true}}
+			})
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (self *recordingServer) state() (int, []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.connections, append([]string(nil), self.methods...)
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for start := time.Now(); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 3*time.Second {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestLazyStart(t *testing.T) {
+	server := &recordingServer{}
+	address := server.listen(t)
+	fromClient, inclusions, _ := InitRoutes(false, []Route{{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"}})
+	supervisor := NewSupervisor(fromClient, inclusions[0], "tcp:"+address, nil)
+	supervisor.Transport = Transport{Kind: TransportTCP, Address: address}
+	supervisor.Lazy = true
+	supervisor.IdleTimeout = 100 * time.Millisecond
+	supervisor.StartupPeriod = 500 * time.Millisecond
+	go supervisor.Run()
+	defer supervisor.kill()
+	client := connectClient(t, fromClient)
+	client.Handle(protocol.ServerClientRegisterCapability, func(json.RawMessage) (any, error) { return nil, nil })
+
+	send := func(method string, params string) any {
+		r, _, _, _ := fromClient.Handler.Handle(&glsp.Context{
+			Method:       method,
+			Params:       []byte(params),
+			Notification: method != protocol.MethodInitialize && method != protocol.MethodTextDocumentHover,
+			Context:      contextpkg.Background(),
+		})
+		return r
+	}
+
+	result := send(protocol.MethodInitialize, `{"rootUri": "file:///project", "capabilities": {"textDocument": {"hover": {"dynamicRegistration": true}}}}`)
+	if got, _ := json.Marshal(result); string(got) != `{"capabilities":{"textDocumentSync":{"change":2,"openClose":true}}}` {
+		t.Errorf("Expected initialize to be answered with document sync only before the server starts, Got: %s", got)
+	}
+	send(protocol.MethodTextDocumentDidOpen, `{"textDocument": {"uri": "file:///plain.go", "languageId": "go", "version": 1, "text": "x"}}`)
+	time.Sleep(50 * time.Millisecond)
+	if connections, _ := server.state(); connections != 0 {
+		t.Fatalf("Expected the server not to start without inclusions, Got: %d connections", connections)
+	}
+
+	send(protocol.MethodTextDocumentDidOpen, `{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x ~<p>~"}}`)
+	if result := send(protocol.MethodTextDocumentHover, `{"textDocument": {"uri": "file:///a.go"}, "position": {"line": 0, "character": 4}}`); result == nil {
+		t.Errorf("Expected the hover to wait for the server and be answered")
+	}
+	_, methods := server.state()
+	expected := []string{protocol.MethodInitialize, protocol.MethodInitialized}
+	if len(methods) < 2 || methods[0] != expected[0] || methods[1] != expected[1] {
+		t.Errorf("Expected the server to be initialized first, Got: %v", methods)
+	}
+	// Only what the client can register dynamically
+	message, err := client.WaitFor(protocol.ServerClientRegisterCapability)
+	var registration protocol.RegistrationParams
+	if err != nil || message.Decode(&registration) != nil || len(registration.Registrations) != 1 || registration.Registrations[0].Method != protocol.MethodTextDocumentHover {
+		t.Errorf("Expected the hover to be registered with the client, Got: %s, %v", message.Params, err)
+	}
+
+	send(protocol.MethodTextDocumentDidClose, `{"textDocument": {"uri": "file:///a.go"}}`)
+	waitFor(t, "the idle server to be shut down", func() bool {
+		_, methods := server.state()
+		return len(methods) > 0 && methods[len(methods)-1] == protocol.MethodExit
+	})
+
+	send(protocol.MethodTextDocumentDidOpen, `{"textDocument": {"uri": "file:///b.go", "languageId": "go", "version": 1, "text": "~<b>~"}}`)
+	waitFor(t, "the server to start again", func() bool {
+		connections, _ := server.state()
+		return connections == 2
+	})
+	registrations := 0
+	for _, message := range client.Received() {
+		if message.Method == protocol.ServerClientRegisterCapability {
+			registrations++
+		}
+	}
+	if registrations != 1 {
+		t.Errorf("Expected the capabilities to be registered once, Got: %d registrations", registrations)
+	}
+}
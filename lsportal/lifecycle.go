@@ -0,0 +1,110 @@
+package lsportal
+
+// The lifecycle takes the inclusion servers through the LSP shutdown sequence along with the client.
+// shutdown is answered once every inclusion server answered it, exit is forwarded, and once the client is gone every
+// server gets a grace period to exit before it is killed.
+
+import (
+	contextpkg "context"
+	"sync"
+	"time"
+
+	"github.com/tliron/commonlog"
+	. "github.com/tliron/glsp/protocol_3_16"
+)
+
+type Lifecycle struct {
+	logger     commonlog.Logger
+	inclusions []*Inclusion
+	// How long the inclusion servers get to exit on their own before they are killed
+	GracePeriod time.Duration
+
+	lock     sync.Mutex
+	shutdown bool
+	exited   bool
+}
+
+func newLifecycle(inclusions []*Inclusion) *Lifecycle {
+	return &Lifecycle{
+		logger:      commonlog.GetLogger("lifecycle"),
+		inclusions:  inclusions,
+		GracePeriod: 5 * time.Second,
+	}
+}
+
+// Called before shutdown is forwarded, the servers exiting from here on is expected so they aren't restarted
+func (self *Lifecycle) shuttingDown() {
+	self.lock.Lock()
+	self.shutdown = true
+	self.lock.Unlock()
+	for _, inclusion := range self.inclusions {
+		if inclusion.supervisor != nil {
+			inclusion.supervisor.Stop()
+		}
+	}
+}
+
+// Forwards exit to every inclusion server, only the first call does anything
+func (self *Lifecycle) exit() {
+	self.lock.Lock()
+	if self.exited {
+		self.lock.Unlock()
+		return
+	}
+	self.exited = true
+	self.lock.Unlock()
+
+	for _, inclusion := range self.inclusions {
+		if inclusion.supervisor != nil {
+			inclusion.supervisor.Stop()
+		}
+		connection := connectionOf(inclusion.Server)
+		if connection == nil {
+			continue
+		}
+		ctx, cancel := contextpkg.WithTimeout(contextpkg.Background(), time.Second)
+		if err := connection.Notify(ctx, MethodExit, nil); err != nil {
+			self.logger.Warningf("error forwarding exit to %s: %v", inclusion.Server.LogBaseName, err)
+		}
+		cancel()
+	}
+}
+
+// Call once the client connection is closed. Makes sure every inclusion server exits, killing the ones that don't
+// within the grace period, and returns the exit code the spec asks for: 0 if shutdown came before exit, 1 otherwise
+func (self *Lifecycle) Wait() int {
+	// The client may have just gone away, the servers still need to be told to exit
+	self.exit()
+
+	var wg sync.WaitGroup
+	for _, inclusion := range self.inclusions {
+		supervisor := inclusion.supervisor
+		if supervisor == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-supervisor.done:
+				return
+			case <-time.After(self.GracePeriod):
+			}
+			self.logger.Warningf("%s didn't exit within %s, killing it", supervisor.Command, self.GracePeriod)
+			supervisor.kill()
+			select {
+			case <-supervisor.done:
+			case <-time.After(self.GracePeriod):
+				self.logger.Errorf("%s still hasn't exited, giving up on it", supervisor.Command)
+			}
+		}()
+	}
+	wg.Wait()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.shutdown {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,59 @@
+package lsportal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestLifecycleExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		methods  []string
+		expected int
+	}{
+		{"shutdown then exit", []string{protocol.MethodShutdown, protocol.MethodExit}, 0},
+		{"exit without shutdown", []string{protocol.MethodExit}, 1},
+		{"client went away", nil, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lifecycle := newLifecycle(nil)
+			router := RouterHandler{lifecycle: lifecycle}
+			for _, method := range test.methods {
+				router.Handle(&glsp.Context{Method: method, Notification: method == protocol.MethodExit})
+			}
+			if code := lifecycle.Wait(); code != test.expected {
+				t.Errorf("Expected exit code %d, Got: %d", test.expected, code)
+			}
+		})
+	}
+}
+
+func TestLifecycleKillsServersThatDontExit(t *testing.T) {
+	_, inclusions, lifecycle := InitRoutes(false, []Route{{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"}})
+	lifecycle.GracePeriod = 100 * time.Millisecond
+	// Doesn't speak LSP, so it never reacts to exit
+	supervisor := NewSupervisor(nil, inclusions[0], "sleep", []string{"30"})
+	supervisor.Dir = t.TempDir()
+	go supervisor.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan int)
+	go func() { done <- lifecycle.Wait() }()
+	select {
+	case code := <-done:
+		if code != 1 {
+			t.Errorf("Expected exit code 1, Got: %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to be killed after the grace period")
+	}
+	select {
+	case <-supervisor.done:
+	default:
+		t.Error("Expected the supervisor to have stopped")
+	}
+}
@@ -0,0 +1,102 @@
+package lsptest
+
+import (
+	"encoding/json"
+	"io"
+
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+// A fake editor. Requests from the server, like workspace/configuration, are answered with null unless scripted
+type Client struct {
+	peer
+}
+
+// Connects to lsportal, or a server, over the stream
+func NewClient(stream io.ReadWriteCloser) *Client {
+	self := &Client{peer: newPeer()}
+	self.answerNull = true
+	self.serve(stream)
+	return self
+}
+
+func (self *Client) Initialize(rootUri protocol.DocumentUri) (map[string]any, error) {
+	var result map[string]any
+	if err := self.Call(protocol.MethodInitialize, map[string]any{"processId": nil, "rootUri": rootUri, "capabilities": map[string]any{}}, &result); err != nil {
+		return nil, err
+	}
+	return result, self.Notify(protocol.MethodInitialized, map[string]any{})
+}
+
+func (self *Client) DidOpen(uri protocol.DocumentUri, languageId string, text string) error {
+	return self.Notify(protocol.MethodTextDocumentDidOpen, protocol.DidOpenTextDocumentParams{
+		TextDocument: protocol.TextDocumentItem{URI: uri, LanguageID: languageId, Version: 1, Text: text},
+	})
+}
+
+// Replaces the whole text of the document
+func (self *Client) DidChange(uri protocol.DocumentUri, version protocol.Integer, text string) error {
+	return self.Notify(protocol.MethodTextDocumentDidChange, protocol.DidChangeTextDocumentParams{
+		TextDocument:   protocol.VersionedTextDocumentIdentifier{TextDocumentIdentifier: protocol.TextDocumentIdentifier{URI: uri}, Version: version},
+		ContentChanges: []any{protocol.TextDocumentContentChangeEventWhole{Text: text}},
+	})
+}
+
+func (self *Client) DidClose(uri protocol.DocumentUri) error {
+	return self.Notify(protocol.MethodTextDocumentDidClose, protocol.DidCloseTextDocumentParams{
+		TextDocument: protocol.TextDocumentIdentifier{URI: uri},
+	})
+}
+
+func (self *Client) Hover(uri protocol.DocumentUri, line protocol.UInteger, character protocol.UInteger) (*protocol.Hover, error) {
+	var hover *protocol.Hover
+	err := self.Call(protocol.MethodTextDocumentHover, position(uri, line, character), &hover)
+	return hover, err
+}
+
+func (self *Client) Completion(uri protocol.DocumentUri, line protocol.UInteger, character protocol.UInteger) ([]protocol.CompletionItem, error) {
+	var raw json.RawMessage
+	if err := self.Call(protocol.MethodTextDocumentCompletion, position(uri, line, character), &raw); err != nil {
+		return nil, err
+	}
+	// Either a list or just the items
+	var list protocol.CompletionList
+	if err := json.Unmarshal(raw, &list); err == nil && list.Items != nil {
+		return list.Items, nil
+	}
+	var items []protocol.CompletionItem
+	err := json.Unmarshal(raw, &items)
+	return items, err
+}
+
+// Waits for the next diagnostics published for the document
+func (self *Client) WaitForDiagnostics(uri protocol.DocumentUri) ([]protocol.Diagnostic, error) {
+	for {
+		message, err := self.WaitFor(protocol.ServerTextDocumentPublishDiagnostics)
+		if err != nil {
+			return nil, err
+		}
+		var params protocol.PublishDiagnosticsParams
+		if err := message.Decode(&params); err != nil {
+			return nil, err
+		}
+		if params.URI == uri {
+			return params.Diagnostics, nil
+		}
+	}
+}
+
+// Shuts the connection down the way an editor does
+func (self *Client) Shutdown() error {
+	if err := self.Call(protocol.MethodShutdown, nil, nil); err != nil {
+		return err
+	}
+	return self.Notify(protocol.MethodExit, nil)
+}
+
+func position(uri protocol.DocumentUri, line protocol.UInteger, character protocol.UInteger) protocol.TextDocumentPositionParams {
+	return protocol.TextDocumentPositionParams{
+		TextDocument: protocol.TextDocumentIdentifier{URI: uri},
+		Position:     protocol.Position{Line: line, Character: character},
+	}
+}
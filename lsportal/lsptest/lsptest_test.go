@@ -0,0 +1,53 @@
+package lsptest
+
+import (
+	"testing"
+	"time"
+
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestClientAndServer(t *testing.T) {
+	clientSide, serverSide := Pipe()
+	server := NewServer()
+	server.OnHover(func(params protocol.HoverParams) *protocol.Hover {
+		return &protocol.Hover{Contents: protocol.MarkupContent{Kind: protocol.MarkupKindPlainText, Value: params.TextDocument.URI}}
+	})
+	server.Serve(serverSide)
+	defer server.Close()
+	client := NewClient(clientSide)
+	defer client.Close()
+
+	result, err := client.Initialize("file:///project")
+	if err != nil || result["capabilities"] == nil {
+		t.Fatalf("Expected the capabilities, Got: %v, %v", result, err)
+	}
+	if err := client.DidOpen("file:///a.html", "html", "<p>"); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	document, err := server.WaitForOpen()
+	if err != nil || document.Text != "<p>" {
+		t.Errorf("Expected the server to get the document, Got: %v, %v", document, err)
+	}
+
+	hover, err := client.Hover("file:///a.html", 0, 1)
+	if err != nil || hover == nil {
+		t.Fatalf("Expected a hover, Got: %v, %v", hover, err)
+	}
+	if _, err := client.Completion("file:///a.html", 0, 1); err == nil {
+		t.Errorf("Expected unscripted requests to fail")
+	}
+
+	if err := server.PublishDiagnostics("file:///a.html", protocol.Diagnostic{Message: "unclosed"}); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	diagnostics, err := client.WaitForDiagnostics("file:///a.html")
+	if err != nil || len(diagnostics) != 1 || diagnostics[0].Message != "unclosed" {
+		t.Errorf("Expected the diagnostic, Got: %v, %v", diagnostics, err)
+	}
+	defer func(timeout time.Duration) { Timeout = timeout }(Timeout)
+	Timeout = 100 * time.Millisecond
+	if _, err := client.WaitForDiagnostics("file:///a.html"); err == nil {
+		t.Errorf("Expected WaitFor not to return the same message twice")
+	}
+}
@@ -0,0 +1,148 @@
+package lsptest
+
+// Fakes for both ends of lsportal: a language server standing in for the inclusion server and a client standing in
+// for the editor. They only speak JSON-RPC, so they don't depend on lsportal and its own tests can use them.
+// Both remember everything they were sent and answer requests from handlers you can script per method.
+
+import (
+	contextpkg "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// How long calls and waits take before giving up, tests shouldn't hang when a message got lost
+var Timeout = 3 * time.Second
+
+// Answers a request, or gets a notification, with the raw params
+type Handler func(params json.RawMessage) (any, error)
+
+// A message one of the fakes was sent
+type Message struct {
+	Method       string
+	Params       json.RawMessage
+	Notification bool
+}
+
+// Decodes the params into value
+func (self Message) Decode(value any) error {
+	return json.Unmarshal(self.Params, value)
+}
+
+// Connects a fake client and a fake server, or either of them and lsportal, in memory
+func Pipe() (io.ReadWriteCloser, io.ReadWriteCloser) {
+	return net.Pipe()
+}
+
+// What the server and the client have in common
+type peer struct {
+	conn     *jsonrpc2.Conn
+	lock     sync.Mutex
+	handlers map[string]Handler
+	received []Message
+	// Per method, how many messages WaitFor already returned
+	taken map[string]int
+	// Closed and replaced whenever a message arrives
+	changed chan struct{}
+	// Answer requests without a handler with null instead of an error
+	answerNull bool
+}
+
+func newPeer() peer {
+	return peer{handlers: map[string]Handler{}, taken: map[string]int{}, changed: make(chan struct{})}
+}
+
+func (self *peer) serve(stream io.ReadWriteCloser) {
+	self.conn = jsonrpc2.NewConn(contextpkg.Background(), jsonrpc2.NewBufferedStream(stream, jsonrpc2.VSCodeObjectCodec{}),
+		jsonrpc2.HandlerWithError(self.handle))
+}
+
+func (self *peer) handle(ctx contextpkg.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+	message := Message{Method: req.Method, Notification: req.Notif}
+	if req.Params != nil {
+		message.Params = *req.Params
+	}
+	self.lock.Lock()
+	self.received = append(self.received, message)
+	handler := self.handlers[req.Method]
+	close(self.changed)
+	self.changed = make(chan struct{})
+	self.lock.Unlock()
+
+	if handler == nil {
+		if req.Notif || self.answerNull {
+			return nil, nil
+		}
+		return nil, &jsonrpc2.Error{Code: jsonrpc2.CodeMethodNotFound, Message: fmt.Sprintf("lsptest: no handler for %s", req.Method)}
+	}
+	return handler(message.Params)
+}
+
+// Scripts how a method is answered, replacing any earlier handler
+func (self *peer) Handle(method string, handler Handler) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.handlers[method] = handler
+}
+
+// Everything received so far, in order
+func (self *peer) Received() []Message {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]Message(nil), self.received...)
+}
+
+// Waits for the next message with the method that an earlier WaitFor didn't return yet
+func (self *peer) WaitFor(method string) (Message, error) {
+	deadline := time.After(Timeout)
+	for {
+		self.lock.Lock()
+		seen := 0
+		for _, message := range self.received {
+			if message.Method != method {
+				continue
+			}
+			if seen == self.taken[method] {
+				self.taken[method]++
+				self.lock.Unlock()
+				return message, nil
+			}
+			seen++
+		}
+		changed := self.changed
+		self.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return Message{}, fmt.Errorf("lsptest: timed out waiting for %s", method)
+		}
+	}
+}
+
+// Sends a request and decodes the result into result, which may be nil
+func (self *peer) Call(method string, params any, result any) error {
+	ctx, cancel := contextpkg.WithTimeout(contextpkg.Background(), Timeout)
+	defer cancel()
+	if result == nil {
+		var ignored json.RawMessage
+		result = &ignored
+	}
+	return self.conn.Call(ctx, method, params, result)
+}
+
+func (self *peer) Notify(method string, params any) error {
+	return self.conn.Notify(contextpkg.Background(), method, params)
+}
+
+func (self *peer) Close() error {
+	if self.conn == nil {
+		return nil
+	}
+	return self.conn.Close()
+}
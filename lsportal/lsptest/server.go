@@ -0,0 +1,80 @@
+package lsptest
+
+import (
+	"encoding/json"
+	"io"
+
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+// A fake language server. It answers initialize with Capabilities and shutdown with null out of the box, everything
+// else has to be scripted with Handle or the helpers below
+type Server struct {
+	peer
+	Capabilities map[string]any
+}
+
+func NewServer() *Server {
+	self := &Server{
+		peer: newPeer(),
+		Capabilities: map[string]any{
+			"textDocumentSync":   protocol.TextDocumentSyncKindFull,
+			"hoverProvider":      true,
+			"completionProvider": map[string]any{},
+		},
+	}
+	self.Handle(protocol.MethodInitialize, func(json.RawMessage) (any, error) {
+		return map[string]any{"capabilities": self.Capabilities}, nil
+	})
+	self.Handle(protocol.MethodShutdown, func(json.RawMessage) (any, error) {
+		return nil, nil
+	})
+	return self
+}
+
+// Starts answering on the stream, the way an inclusion server would on its stdio
+func (self *Server) Serve(stream io.ReadWriteCloser) {
+	self.serve(stream)
+}
+
+// Answers hovers with whatever hover returns, nil meaning nothing to show
+func (self *Server) OnHover(hover func(params protocol.HoverParams) *protocol.Hover) {
+	self.Handle(protocol.MethodTextDocumentHover, func(raw json.RawMessage) (any, error) {
+		var params protocol.HoverParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		return hover(params), nil
+	})
+}
+
+// Answers completions with the items complete returns
+func (self *Server) OnCompletion(complete func(params protocol.CompletionParams) []protocol.CompletionItem) {
+	self.Handle(protocol.MethodTextDocumentCompletion, func(raw json.RawMessage) (any, error) {
+		var params protocol.CompletionParams
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		return protocol.CompletionList{Items: complete(params)}, nil
+	})
+}
+
+// Publishes diagnostics for the document right away
+func (self *Server) PublishDiagnostics(uri protocol.DocumentUri, diagnostics ...protocol.Diagnostic) error {
+	if diagnostics == nil {
+		diagnostics = []protocol.Diagnostic{}
+	}
+	return self.Notify(protocol.ServerTextDocumentPublishDiagnostics,
+		protocol.PublishDiagnosticsParams{URI: uri, Diagnostics: diagnostics})
+}
+
+// Waits for the next didOpen and returns the document the server was given
+func (self *Server) WaitForOpen() (protocol.TextDocumentItem, error) {
+	message, err := self.WaitFor(protocol.MethodTextDocumentDidOpen)
+	if err != nil {
+		return protocol.TextDocumentItem{}, err
+	}
+	var params protocol.DidOpenTextDocumentParams
+	err = message.Decode(&params)
+	return params.TextDocument, err
+}
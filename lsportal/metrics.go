@@ -0,0 +1,200 @@
+package lsportal
+
+// Metrics about where the time goes, in the Prometheus text format so any scraper can read them.
+// Latency is split into the time we spend transforming a message and the time the other side takes to answer it
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency buckets in seconds, transforms take well under a millisecond and servers up to seconds
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func (self *histogram) observe(seconds float64) {
+	if self.counts == nil {
+		self.counts = make([]int64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			self.counts[i]++
+		}
+	}
+	self.sum += seconds
+	self.count++
+}
+
+// Collects the metrics of every route, a nil Metrics measures nothing.
+// Series are keyed by their rendered labels, eg: `method="textDocument/hover",route=""`
+type Metrics struct {
+	lock     sync.Mutex
+	messages map[string]int64
+	// Requests that got an answer
+	transformSeconds map[string]*histogram
+	innerSeconds     map[string]*histogram
+	isolationSeconds map[string]*histogram
+	inclusions       map[string]int
+	restarts         map[string]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		messages:         map[string]int64{},
+		transformSeconds: map[string]*histogram{},
+		innerSeconds:     map[string]*histogram{},
+		isolationSeconds: map[string]*histogram{},
+		inclusions:       map[string]int{},
+		restarts:         map[string]int64{},
+	}
+}
+
+// Renders label pairs, name then value
+func metricLabels(pairs ...string) string {
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	return strings.Join(labels, ",")
+}
+
+func (self *Metrics) message(from string, kind string, method string, route string) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.messages[metricLabels("from", from, "kind", kind, "method", method, "route", route)]++
+}
+
+// A request was answered, transform is the time we spent on it both ways and inner the time the other side took
+func (self *Metrics) request(from string, method string, route string, transform time.Duration, inner time.Duration) {
+	if self == nil {
+		return
+	}
+	labels := metricLabels("from", from, "method", method, "route", route)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	observe(self.transformSeconds, labels, transform)
+	observe(self.innerSeconds, labels, inner)
+}
+
+// A change was applied to a document and its inclusions isolated again
+func (self *Metrics) isolated(route string, took time.Duration) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	observe(self.isolationSeconds, metricLabels("route", route), took)
+}
+
+// How many inclusions the document has now, a closed document has -1 and is forgotten
+func (self *Metrics) documentInclusions(route string, uri string, count int) {
+	if self == nil {
+		return
+	}
+	labels := metricLabels("route", route, "uri", uri)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if count < 0 {
+		delete(self.inclusions, labels)
+	} else {
+		self.inclusions[labels] = count
+	}
+}
+
+func (self *Metrics) restarted(route string) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.restarts[metricLabels("route", route)]++
+}
+
+func observe(histograms map[string]*histogram, labels string, took time.Duration) {
+	if histograms[labels] == nil {
+		histograms[labels] = &histogram{}
+	}
+	histograms[labels].observe(took.Seconds())
+}
+
+// Writes every metric in the Prometheus text format
+func (self *Metrics) WriteTo(writer io.Writer) (int64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var out strings.Builder
+	writeValues(&out, "lsportal_messages_total", "counter", "Messages forwarded, by the side that sent them", self.messages)
+	writeHistograms(&out, "lsportal_transform_seconds", "Time spent transforming a request and its response", self.transformSeconds)
+	writeHistograms(&out, "lsportal_inner_seconds", "Time the other side took to answer a request", self.innerSeconds)
+	writeHistograms(&out, "lsportal_isolation_seconds", "Time spent applying a didChange and isolating the inclusions", self.isolationSeconds)
+	writeValues(&out, "lsportal_document_inclusions", "gauge", "Inclusions in each open document", self.inclusions)
+	writeValues(&out, "lsportal_inner_restarts_total", "counter", "Times the inclusion server was restarted after exiting", self.restarts)
+	written, err := io.WriteString(writer, out.String())
+	return int64(written), err
+}
+
+// Serves the metrics for scraping ([http.Handler] interface)
+func (self *Metrics) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	self.WriteTo(writer)
+}
+
+// Writes the metrics to the file, replacing it
+func (self *Metrics) WriteFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := self.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func writeHeader(out *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeValues[T int | int64](out *strings.Builder, name string, kind string, help string, values map[string]T) {
+	writeHeader(out, name, kind, help)
+	for _, labels := range sortedKeys(values) {
+		fmt.Fprintf(out, "%s{%s} %d\n", name, labels, values[labels])
+	}
+}
+
+func writeHistograms(out *strings.Builder, name string, help string, histograms map[string]*histogram) {
+	writeHeader(out, name, "histogram", help)
+	for _, labels := range sortedKeys(histograms) {
+		histogram := histograms[labels]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(out, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, histogram.counts[i])
+		}
+		fmt.Fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, histogram.count)
+		fmt.Fprintf(out, "%s_sum{%s} %g\n", name, labels, histogram.sum)
+		fmt.Fprintf(out, "%s_count{%s} %d\n", name, labels, histogram.count)
+	}
+}
+
+func sortedKeys[T any](values map[string]T) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,63 @@
+package lsportal
+
+import (
+	contextpkg "context"
+	"strings"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestMetrics(t *testing.T) {
+	fromClient, inclusion, server := serveRoute(t, Route{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"})
+	metrics := NewMetrics()
+	inclusion.Measure(metrics)
+	server.OnHover(func(params protocol.HoverParams) *protocol.Hover {
+		return &protocol.Hover{Contents: "p"}
+	})
+
+	send := func(method string, params string) {
+		fromClient.Handler.Handle(&glsp.Context{
+			Method:       method,
+			Params:       []byte(params),
+			Notification: method != protocol.MethodTextDocumentHover,
+			Context:      contextpkg.Background(),
+		})
+	}
+	send(protocol.MethodTextDocumentDidOpen, `{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x ~<p>~ ~<b>~"}}`)
+	send(protocol.MethodTextDocumentDidChange, `{"textDocument": {"uri": "file:///a.go", "version": 2}, "contentChanges": [{"text": "x ~<p>~"}]}`)
+	send(protocol.MethodTextDocumentHover, `{"textDocument": {"uri": "file:///a.go"}, "position": {"line": 0, "character": 4}}`)
+	send(protocol.MethodTextDocumentHover, `{"textDocument": {"uri": "file:///a.go"}, "position": {"line": 0, "character": 4}}`)
+
+	var out strings.Builder
+	metrics.WriteTo(&out)
+	tests := []string{
+		`lsportal_messages_total{from="client",kind="request",method="textDocument/hover",route=""} 2`,
+		`lsportal_messages_total{from="client",kind="notification",method="textDocument/didChange",route=""} 1`,
+		`lsportal_transform_seconds_count{from="client",method="textDocument/hover",route=""} 2`,
+		`lsportal_inner_seconds_bucket{from="client",method="textDocument/hover",route="",le="+Inf"} 2`,
+		`lsportal_isolation_seconds_count{route=""} 1`,
+		`lsportal_document_inclusions{route="",uri="file:///a.go"} 1`,
+		`# TYPE lsportal_inner_restarts_total counter`,
+	}
+	for _, expected := range tests {
+		if !strings.Contains(out.String(), expected+"\n") {
+			t.Errorf("Expected the metrics to contain %q, Got:\n%s", expected, out.String())
+		}
+	}
+
+	// Notifications aren't answered, so they have no latency to observe
+	for _, method := range []string{protocol.MethodTextDocumentDidOpen, protocol.MethodTextDocumentDidChange} {
+		if strings.Contains(out.String(), `seconds_count{from="client",method="`+method+`"`) {
+			t.Errorf("Expected no request latency for %s, Got:\n%s", method, out.String())
+		}
+	}
+
+	send(protocol.MethodTextDocumentDidClose, `{"textDocument": {"uri": "file:///a.go"}}`)
+	out.Reset()
+	metrics.WriteTo(&out)
+	if strings.Contains(out.String(), `uri="file:///a.go"`) {
+		t.Errorf("Expected closed documents to be forgotten, Got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,250 @@
+package lsportal
+
+import (
+	"encoding/json"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+// Rewrites the uris, positions and ranges inside a decoded json message so they make sense on the other side of the portal.
+type documentWalker struct {
+	// Looks up a uri found in the message, returning the uri the other side knows the document by and its source map.
+	// The source map may be nil if we aren't tracking the document
+	lookup func(uri string) (string, *SourceMap, bool)
+	// Moves a single position across the source map
+	move func(sourceMap *SourceMap, pos protocol.Position) (protocol.Position, bool)
+	// Moves both ends of a range at once, so a range that can't be moved as a whole isn't moved end by end
+	moveRange func(sourceMap *SourceMap, r protocol.Range) (protocol.Range, bool)
+	// Optionally checks the range of an edit before it is moved, edits that fail are dropped
+	editable func(sourceMap *SourceMap, r protocol.Range) bool
+}
+
+// Keys of objects that say which document the positions within them belong to
+var uriKeys = []string{"uri", "targetUri"}
+
+// Keys of the ranges a TextEdit or InsertReplaceEdit replaces
+var editRangeKeys = []string{"range", "insert", "replace"}
+
+// Walks the value rewriting it in place, positions are moved using the source map of the closest enclosing document.
+// Array items that contain an unmappable position are dropped, eg: a diagnostic or edit within an injected prefix.
+// Returns false if an unmappable position was found outside of an array
+func (walker documentWalker) walk(value any, sourceMap *SourceMap) (any, bool) {
+	switch value := value.(type) {
+	case map[string]any:
+		outerMap := sourceMap
+		sourceMap = walker.findDocument(value, sourceMap)
+
+		if _, isEdit := value["newText"]; isEdit && walker.editable != nil {
+			for _, key := range editRangeKeys {
+				if r, ok := asRange(value[key]); ok && !walker.editable(sourceMap, r) {
+					return value, false
+				}
+			}
+		}
+		if r, ok := asRange(value); ok && len(value) == 2 {
+			moved, ok := walker.moveRange(sourceMap, r)
+			if !ok {
+				return value, false
+			}
+			setPosition(value["start"].(map[string]any), moved.Start)
+			setPosition(value["end"].(map[string]any), moved.End)
+			return value, true
+		}
+		if pos, ok := asPosition(value); ok {
+			moved, ok := walker.move(sourceMap, pos)
+			if !ok {
+				return value, false
+			}
+			setPosition(value, moved)
+			return value, true
+		}
+		for key, field := range value {
+			fieldMap := sourceMap
+			// In a LocationLink the origin is in the document the request was about, not the target
+			if key == "originSelectionRange" {
+				fieldMap = outerMap
+			}
+			newField, ok := walker.walk(field, fieldMap)
+			if !ok {
+				return value, false
+			}
+			value[key] = newField
+		}
+		return value, true
+	case []any:
+		kept := value[:0]
+		for _, item := range value {
+			if newItem, ok := walker.walk(item, sourceMap); ok {
+				kept = append(kept, newItem)
+			}
+		}
+		return kept, true
+	default:
+		return value, true
+	}
+}
+
+// Walks the fields of a response object on their own, so a field with an unmappable position is dropped rather than
+// the whole response, eg: the range of a hover. An object naming its document, eg: a Location, means nothing without
+// its positions and is walked whole
+func (walker documentWalker) walkFields(value any, sourceMap *SourceMap) (any, bool) {
+	object, ok := value.(map[string]any)
+	if !ok {
+		return walker.walk(value, sourceMap)
+	}
+	if _, ok := asRange(object); ok {
+		return walker.walk(value, sourceMap)
+	}
+	for _, key := range []string{"uri", "targetUri", "textDocument", "newText", "line"} {
+		if _, ok := object[key]; ok {
+			return walker.walk(value, sourceMap)
+		}
+	}
+	for key, field := range object {
+		moved, ok := walker.walk(field, sourceMap)
+		if !ok {
+			delete(object, key)
+			continue
+		}
+		object[key] = moved
+	}
+	return object, true
+}
+
+// Rewrites the uri of the object if it has one, returning the source map positions within it should use
+func (walker documentWalker) findDocument(value map[string]any, sourceMap *SourceMap) *SourceMap {
+	for _, key := range uriKeys {
+		if uri, ok := value[key].(string); ok {
+			if newUri, newMap, ok := walker.lookup(uri); ok {
+				value[key] = newUri
+				return newMap
+			}
+		}
+	}
+	// Request params name their document in a sibling textDocument field, which rewrites its own uri when walked
+	if textDocument, ok := value["textDocument"].(map[string]any); ok {
+		if uri, ok := textDocument["uri"].(string); ok {
+			if _, newMap, ok := walker.lookup(uri); ok {
+				return newMap
+			}
+		}
+	}
+	return sourceMap
+}
+
+// Finds the source map of the document a forwarded request was about, using the uri as it was sent
+func (walker documentWalker) requestSourceMap(context *glsp.Context) *SourceMap {
+	_, sourceMap, _ := walker.lookup(requestUri(context))
+	return sourceMap
+}
+
+// The uri of the document a request is about, empty if it isn't about one
+func requestUri(context *glsp.Context) string {
+	if context == nil || len(context.Params) == 0 {
+		return ""
+	}
+	var params struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+	}
+	if err := json.Unmarshal(context.Params, &params); err != nil {
+		return ""
+	}
+	return params.TextDocument.URI
+}
+
+// Checks if the object is an lsp Position
+func asPosition(value map[string]any) (protocol.Position, bool) {
+	if len(value) != 2 {
+		return protocol.Position{}, false
+	}
+	line, ok := value["line"].(float64)
+	if !ok {
+		return protocol.Position{}, false
+	}
+	character, ok := value["character"].(float64)
+	if !ok {
+		return protocol.Position{}, false
+	}
+	return protocol.Position{Line: protocol.UInteger(line), Character: protocol.UInteger(character)}, true
+}
+
+func setPosition(value map[string]any, pos protocol.Position) {
+	value["line"] = float64(pos.Line)
+	value["character"] = float64(pos.Character)
+}
+
+// Checks if the value is an lsp Range
+func asRange(value any) (protocol.Range, bool) {
+	object, ok := value.(map[string]any)
+	if !ok {
+		return protocol.Range{}, false
+	}
+	start, ok := object["start"].(map[string]any)
+	if !ok {
+		return protocol.Range{}, false
+	}
+	end, ok := object["end"].(map[string]any)
+	if !ok {
+		return protocol.Range{}, false
+	}
+	startPos, ok := asPosition(start)
+	if !ok {
+		return protocol.Range{}, false
+	}
+	endPos, ok := asPosition(end)
+	if !ok {
+		return protocol.Range{}, false
+	}
+	return protocol.Range{Start: startPos, End: endPos}, true
+}
+
+// Walks messages going from the client to the inclusion server
+func (trans *FromClientTransformer) toVirtual() documentWalker {
+	return documentWalker{
+		lookup: func(uri string) (string, *SourceMap, bool) {
+			doc, ok := trans.Documents[uri]
+			if !ok {
+				return uri, nil, false
+			}
+			return trans.changeExtension(uri), &doc.SourceMap, true
+		},
+		move: func(sourceMap *SourceMap, pos protocol.Position) (protocol.Position, bool) {
+			return sourceMap.ToVirtual(pos)
+		},
+		moveRange: (*SourceMap).RangeToVirtual,
+	}
+}
+
+// Walks messages going from the inclusion server to the client
+func (trans *FromClientTransformer) toHost() documentWalker {
+	return documentWalker{
+		lookup: func(uri string) (string, *SourceMap, bool) {
+			originalUri, ok := trans.UriMap[uri]
+			if !ok {
+				return uri, nil, false
+			}
+			if doc, ok := trans.Documents[originalUri]; ok {
+				return originalUri, &doc.SourceMap, true
+			}
+			return originalUri, nil, true
+		},
+		move: func(sourceMap *SourceMap, pos protocol.Position) (protocol.Position, bool) {
+			return sourceMap.ToHost(pos)
+		},
+		moveRange: (*SourceMap).RangeToHost,
+		editable: func(sourceMap *SourceMap, r protocol.Range) bool {
+			return sourceMap.EditableInVirtual(r)
+		},
+	}
+}
+
+// Finds the source map for the document with the given client side uri
+func (trans *FromClientTransformer) sourceMapFor(uri string) *SourceMap {
+	if doc, ok := trans.Documents[uri]; ok {
+		return &doc.SourceMap
+	}
+	return nil
+}
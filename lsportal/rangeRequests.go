@@ -0,0 +1,143 @@
+package lsportal
+
+// Requests about a range of the document, eg: the inlay hints of what's on screen, may span host code and several
+// inclusions. The inner server should only see the parts within inclusions, so the range is intersected with them:
+// a request overlapping several inclusions is split into a request for each, and their results are merged like the
+// router merges the results of several servers. A request missing the inclusions is answered with nothing right away.
+// rangeFormatting goes its own way, see formatting.go
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
+)
+
+// Not part of 3.16
+const MethodTextDocumentInlayHint = Method("textDocument/inlayHint")
+
+// The methods whose range is intersected with the inclusions, with the empty result of each
+var rangeMethods = map[string]func() any{
+	MethodTextDocumentCodeAction:          func() any { return []any{} },
+	MethodTextDocumentInlayHint:           func() any { return []any{} },
+	MethodTextDocumentSemanticTokensRange: func() any { return semanticTokensResult{Data: []uint32{}} },
+	MethodTextDocumentColorPresentation:   func() any { return []any{} },
+}
+
+// The parts of the range that lie within inclusions, in order. An empty range, eg: the cursor, takes the inclusion it
+// touches, any other range has to overlap an inclusion by more than its bounds
+func (textDocument *TextDocument) intersectInclusions(r Range) []Range {
+	var parts []Range
+	empty := comparePositions(r.Start, r.End) == 0
+	for _, inclusion := range textDocument.Inclusions {
+		if empty && (comparePositions(r.Start, inclusion.Start) < 0 || comparePositions(r.Start, inclusion.End) > 0) {
+			continue
+		}
+		if !empty && (comparePositions(r.End, inclusion.Start) <= 0 || comparePositions(r.Start, inclusion.End) >= 0) {
+			continue
+		}
+		part := r
+		if comparePositions(part.Start, inclusion.Start) < 0 {
+			part.Start = inclusion.Start
+		}
+		if comparePositions(part.End, inclusion.End) > 0 {
+			part.End = inclusion.End
+		}
+		parts = append(parts, part)
+		if empty {
+			// Where two inclusions meet the first one has it
+			break
+		}
+	}
+	return parts
+}
+
+// The parts of the range of a range request as the client sent it, nil for other requests
+func (trans *FromClientTransformer) requestRanges(context *glsp.Context) []Range {
+	if _, ok := rangeMethods[context.Method]; !ok {
+		return nil
+	}
+	var params struct {
+		Range Range `json:"range"`
+	}
+	if err := json.Unmarshal(context.Params, &params); err != nil {
+		return nil
+	}
+	trans.lock.RLock()
+	defer trans.lock.RUnlock()
+	doc := trans.Documents[requestUri(context)]
+	return doc.intersectInclusions(params.Range)
+}
+
+// Cuts the range of a range request down to the inclusion it overlaps, call with the lock held
+func (trans *FromClientTransformer) clampRangeRequest(context *glsp.Context) error {
+	return runParamsTransform(context, func(params *map[string]any) error {
+		doc := trans.Documents[requestUri(context)]
+		r, ok := asRange((*params)["range"])
+		if !ok {
+			return nil
+		}
+		parts := doc.intersectInclusions(r)
+		if len(parts) == 0 {
+			return &rejectedError{reason: context.Method + " outside of the inclusions", result: rangeMethods[context.Method]()}
+		}
+		// A range overlapping several inclusions was split by the forwarder already
+		(*params)["range"] = parts[0]
+		if context.Method == MethodTextDocumentCodeAction {
+			filterCodeActionDiagnostics(*params, &doc)
+		}
+		return nil
+	})
+}
+
+// Forwards the request once for each of the ranges and merges the results, as part of the request the client sent.
+// Returns how long the transformer and the inner server took
+func (self *ForwarderHandler) splitRangeRequest(context *glsp.Context, id string, ranges []Range) (any, time.Duration, time.Duration, error) {
+	var transformed, inner time.Duration
+	var params map[string]any
+	if err := json.Unmarshal(context.Params, &params); err != nil {
+		return nil, transformed, inner, err
+	}
+	merge := mergeResults
+	if isSemanticTokensMethod(context.Method) {
+		merge = mergeSemanticTokens
+	}
+	var merged any
+	for _, r := range ranges {
+		params["range"] = r
+		partParams, err := json.Marshal(params)
+		if err != nil {
+			return nil, transformed, inner, err
+		}
+		part := *context
+		part.Params = partParams
+		start := time.Now()
+		if err := self.Transformer.TransformRequest(&part); err != nil {
+			return nil, transformed, inner, err
+		}
+		transformed += time.Since(start)
+
+		self.tracer.message(self.hops.out, id, "", "request", part.Method, self.route, part.Params)
+		sent := time.Now()
+		_, forwardSpan := startSpan(part.Context, "forward "+part.Method, spanClient)
+		res, err := self.forwardMessage(&part, id)
+		forwardSpan.end(err)
+		inner += time.Since(sent)
+		if err != nil {
+			self.tracer.response(self.hops.responseIn, id, "", part.Method, self.route, nil, err, sent)
+			return nil, transformed, inner, err
+		}
+		self.tracer.response(self.hops.responseIn, id, "", part.Method, self.route, *res, nil, sent)
+
+		start = time.Now()
+		if *res != nil {
+			if err := self.Transformer.TransformResponse(&part, res); err != nil {
+				return nil, transformed, inner, err
+			}
+		}
+		transformed += time.Since(start)
+		merged = merge(merged, *res)
+	}
+	return merged, transformed, inner, nil
+}
@@ -0,0 +1,86 @@
+package lsportal
+
+import (
+	"bytes"
+	contextpkg "context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestIntersectInclusions(t *testing.T) {
+	position := func(line, character protocol.UInteger) protocol.Position {
+		return protocol.Position{Line: line, Character: character}
+	}
+	doc := TextDocument{Inclusions: []protocol.Range{{Start: position(0, 5), End: position(0, 9)}, {Start: position(2, 0), End: position(4, 1)}}}
+	tests := []struct {
+		name     string
+		r        protocol.Range
+		expected []protocol.Range
+	}{
+		{"inside one inclusion", protocol.Range{Start: position(0, 6), End: position(0, 7)}, []protocol.Range{{Start: position(0, 6), End: position(0, 7)}}},
+		{"cut down to the inclusion", protocol.Range{Start: position(1, 0), End: position(3, 0)}, []protocol.Range{{Start: position(2, 0), End: position(3, 0)}}},
+		{"split over inclusions", protocol.Range{Start: position(0, 0), End: position(9, 0)}, []protocol.Range{{Start: position(0, 5), End: position(0, 9)}, {Start: position(2, 0), End: position(4, 1)}}},
+		{"outside the inclusions", protocol.Range{Start: position(1, 0), End: position(1, 3)}, nil},
+		{"touching the start of an inclusion", protocol.Range{Start: position(0, 0), End: position(0, 5)}, nil},
+		{"touching the end of an inclusion", protocol.Range{Start: position(0, 9), End: position(1, 0)}, nil},
+		{"cursor at the start of an inclusion", protocol.Range{Start: position(2, 0), End: position(2, 0)}, []protocol.Range{{Start: position(2, 0), End: position(2, 0)}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := doc.intersectInclusions(test.r); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("Expected: %v, Got: %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSplitRangeRequest(t *testing.T) {
+	fromClient, inclusion, server := serveRoute(t, Route{Isolation: Isolation{Regex: "htmlT\\(`([\\s\\S]*?)`\\)"}, Extension: "html"})
+	var trace bytes.Buffer
+	inclusion.Trace(NewTracer(&trace))
+	// A hint at the start of every range asked for
+	server.Handle(MethodTextDocumentInlayHint, func(raw json.RawMessage) (any, error) {
+		var params struct {
+			Range protocol.Range `json:"range"`
+		}
+		json.Unmarshal(raw, &params)
+		return []any{map[string]any{"position": params.Range.Start, "label": "hint"}}, nil
+	})
+
+	open, _ := json.Marshal(protocol.DidOpenTextDocumentParams{TextDocument: protocol.TextDocumentItem{URI: "file:///a.go", LanguageID: "go", Version: 1, Text: "a := htmlT(`<b>`)\nb := 1\nc := htmlT(`<i>`)"}})
+	fromClient.Handler.Handle(&glsp.Context{Method: protocol.MethodTextDocumentDidOpen, Params: open, Notification: true, Context: contextpkg.Background()})
+	inlayHints := func(r string) (any, error) {
+		result, _, _, err := fromClient.Handler.Handle(&glsp.Context{
+			Method:  MethodTextDocumentInlayHint,
+			Params:  []byte(`{"textDocument": {"uri": "file:///a.go"}, "range": ` + r + `}`),
+			Context: contextpkg.Background(),
+		})
+		got, _ := json.Marshal(derefResult(result))
+		return string(got), err
+	}
+
+	got, err := inlayHints(`{"start": {"line": 0, "character": 0}, "end": {"line": 2, "character": 17}}`)
+	if expected := `[{"data":{"lsportalRoute":"","lsportalUri":"file:///a.go"},"label":"hint","position":{"character":12,"line":0}},{"data":{"lsportalRoute":"","lsportalUri":"file:///a.go"},"label":"hint","position":{"character":12,"line":2}}]`; err != nil || got != expected {
+		t.Errorf("Expected a hint for each inclusion: %s, Got: %s, %v", expected, got, err)
+	}
+	// One request from the client, sent on in two parts
+	hops := map[Hop]int{}
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		var entry TraceEntry
+		if json.Unmarshal([]byte(line), &entry) == nil && entry.Method == MethodTextDocumentInlayHint {
+			hops[entry.Hop]++
+		}
+	}
+	if expected := map[Hop]int{HopClientToPortal: 1, HopPortalToInner: 2, HopInnerToPortal: 2, HopPortalToClient: 1}; !reflect.DeepEqual(hops, expected) {
+		t.Errorf("Expected the parts in the trace of the request: %v, Got: %v", expected, hops)
+	}
+	got, err = inlayHints(`{"start": {"line": 1, "character": 0}, "end": {"line": 1, "character": 6}}`)
+	if err != nil || got != `[]` {
+		t.Errorf("Expected no hints outside of the inclusions, Got: %s, %v", got, err)
+	}
+}
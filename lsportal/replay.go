@@ -0,0 +1,296 @@
+package lsportal
+
+// Replaying a recorded session against a fake inclusion server, for regression tests.
+// `lsportal record` writes a trace (see [Tracer]) that starts with the setup it was made with. Replay feeds the client
+// messages of the recording through InitRoutes, with a fake inclusion server per route answering the way the real one
+// did, and hands back everything lsportal sent to either side so it can be compared against a golden file.
+
+import (
+	"bufio"
+	"bytes"
+	contextpkg "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// The kind of the trace entry describing the setup of a recording
+const traceSetup = "setup"
+
+// The lsportal setup a recording was made with, so it can be replayed the same way
+type RecordingSetup struct {
+	// Every route of the session, the main one first
+	Routes []Route `json:"routes,omitempty"`
+	// Recordings made before there were routes only have the isolation and extension of the main one
+	Isolation *Isolation `json:"isolation,omitempty"`
+	Extension string     `json:"extension,omitempty"`
+}
+
+// The routes to replay the recording with
+func (self RecordingSetup) routes() []Route {
+	if len(self.Routes) > 0 || self.Isolation == nil {
+		return self.Routes
+	}
+	return []Route{{Isolation: *self.Isolation, Extension: self.Extension}}
+}
+
+// Writes the setup the session is recorded with, call before anything else is traced
+func (self *Tracer) RecordSetup(routes []Route) {
+	self.message("", "", "", traceSetup, "", "", RecordingSetup{Routes: routes})
+}
+
+type Recording struct {
+	Setup   RecordingSetup
+	Entries []TraceEntry
+}
+
+func ReadRecording(path string) (*Recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	recording := &Recording{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry TraceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", path, err)
+		}
+		if entry.Kind == traceSetup {
+			if err := json.Unmarshal(entry.Message, &recording.Setup); err != nil {
+				return nil, fmt.Errorf("error reading the setup of %s: %v", path, err)
+			}
+			continue
+		}
+		recording.Entries = append(recording.Entries, entry)
+	}
+	return recording, scanner.Err()
+}
+
+// A message as it left lsportal during a replay
+type ReplayedMessage struct {
+	Hop Hop `json:"hop"`
+	// The route of the inclusion server it was sent to, empty for the main one and the client
+	Route   string          `json:"route,omitempty"`
+	Kind    string          `json:"kind"`
+	Method  string          `json:"method"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// How long we wait for a forwarded notification to come out the other side
+const replayWait = time.Second
+
+type replayer struct {
+	lock sync.Mutex
+	// What the fake inclusion servers, by route, and client answer, by method in the order they were recorded
+	innerResponses  map[string]map[string][]TraceEntry
+	clientResponses map[string][]TraceEntry
+	output          []ReplayedMessage
+}
+
+// Replays the recording and returns everything lsportal sent to the client and the inclusion server, in order
+func Replay(recording *Recording) ([]ReplayedMessage, error) {
+	routes := recording.Setup.routes()
+	if len(routes) == 0 {
+		return nil, errors.New("the recording has no setup to replay it with")
+	}
+	self := &replayer{innerResponses: map[string]map[string][]TraceEntry{}, clientResponses: map[string][]TraceEntry{}}
+	for _, route := range routes {
+		self.innerResponses[route.Name] = map[string][]TraceEntry{}
+	}
+	for _, entry := range recording.Entries {
+		if entry.Kind != "response" && entry.Kind != "error" {
+			continue
+		}
+		switch entry.Hop {
+		case HopInnerToPortal:
+			responses, ok := self.innerResponses[entry.Route]
+			if !ok {
+				return nil, fmt.Errorf("the recording has responses of route %q, which isn't in its setup", entry.Route)
+			}
+			responses[entry.Method] = append(responses[entry.Method], entry)
+		case HopClientToPortal:
+			self.clientResponses[entry.Method] = append(self.clientResponses[entry.Method], entry)
+		}
+	}
+
+	fromClient, inclusions, _ := InitRoutes(false, routes)
+	clientSide, portalClientSide := net.Pipe()
+	go ServeStream(fromClient, portalClientSide)
+	ctx := contextpkg.Background()
+	client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientSide, jsonrpc2.VSCodeObjectCodec{}),
+		jsonrpc2.HandlerWithError(self.handler(HopPortalToClient, "", self.clientResponses)))
+	defer client.Close()
+	inners := map[string]*jsonrpc2.Conn{}
+	for i, inclusion := range inclusions {
+		route := routes[i].Name
+		innerSide, portalInnerSide := net.Pipe()
+		go ServeStream(inclusion.Server, portalInnerSide)
+		inner := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(innerSide, jsonrpc2.VSCodeObjectCodec{}),
+			jsonrpc2.HandlerWithError(self.handler(HopPortalToInner, route, self.innerResponses[route])))
+		defer inner.Close()
+		inners[route] = inner
+	}
+
+	for _, entry := range dropBroadcastCopies(recording.Entries) {
+		var sender *jsonrpc2.Conn
+		var responseHop, forwardedHop Hop
+		switch entry.Hop {
+		case HopClientToPortal:
+			sender, responseHop, forwardedHop = client, HopPortalToClient, HopPortalToInner
+		case HopInnerToPortal:
+			sender, responseHop, forwardedHop = inners[entry.Route], HopPortalToInner, HopPortalToClient
+			if sender == nil {
+				return self.output, fmt.Errorf("the recording has messages of route %q, which isn't in its setup", entry.Route)
+			}
+		default:
+			continue
+		}
+		params := any(nil)
+		if len(entry.Message) > 0 {
+			params = entry.Message
+		}
+		switch entry.Kind {
+		case "request":
+			var result json.RawMessage
+			callCtx, cancel := contextpkg.WithTimeout(ctx, 5*time.Second)
+			err := sender.Call(callCtx, entry.Method, params, &result)
+			cancel()
+			route := ""
+			if responseHop == HopPortalToInner {
+				route = entry.Route
+			}
+			self.record(responseHop, route, entry.Method, result, err)
+		case "notification":
+			seen := self.count(forwardedHop, entry.Method)
+			if err := sender.Notify(ctx, entry.Method, params); err != nil {
+				return self.output, fmt.Errorf("error sending %s: %v", entry.Method, err)
+			}
+			// Notifications don't wait for anything, so wait for it to come out the other side to keep the order
+			for start := time.Now(); self.count(forwardedHop, entry.Method) == seen && time.Since(start) < replayWait; {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.output, nil
+}
+
+// The router hands some client messages to every route, which each trace them, so only the first copy is kept.
+// Requests are told apart by the id the client sent them with, notifications by being sent to a route again
+func dropBroadcastCopies(entries []TraceEntry) []TraceEntry {
+	var kept []TraceEntry
+	requests := map[string]bool{}
+	var notification TraceEntry
+	// The routes the last notification from the client was traced by
+	notified := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Hop == HopClientToPortal && entry.Kind == "request" && entry.RequestID != "" {
+			if requests[entry.RequestID] {
+				continue
+			}
+			requests[entry.RequestID] = true
+		}
+		if entry.Hop == HopClientToPortal && entry.Kind == "notification" {
+			if entry.Method == notification.Method && bytes.Equal(entry.Message, notification.Message) && !notified[entry.Route] {
+				notified[entry.Route] = true
+				continue
+			}
+			notification, notified = entry, map[string]bool{entry.Route: true}
+		}
+		kept = append(kept, entry)
+	}
+	return kept
+}
+
+// The fake inclusion server of the route or client, answering requests with the next recorded response for the method
+func (self *replayer) handler(hop Hop, route string, responses map[string][]TraceEntry) func(contextpkg.Context, *jsonrpc2.Conn, *jsonrpc2.Request) (any, error) {
+	return func(ctx contextpkg.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+		var params json.RawMessage
+		if req.Params != nil {
+			params = *req.Params
+		}
+		kind := "request"
+		if req.Notif {
+			kind = "notification"
+		}
+		self.append(ReplayedMessage{Hop: hop, Route: route, Kind: kind, Method: req.Method, Message: normalizeJson(params)})
+		if req.Notif {
+			return nil, nil
+		}
+
+		self.lock.Lock()
+		queue := responses[req.Method]
+		if len(queue) == 0 {
+			self.lock.Unlock()
+			return nil, fmt.Errorf("no recorded response for %s", req.Method)
+		}
+		response := queue[0]
+		responses[req.Method] = queue[1:]
+		self.lock.Unlock()
+		if response.Kind == "error" {
+			return nil, errors.New(response.Error)
+		}
+		if len(response.Message) == 0 {
+			return nil, nil
+		}
+		return response.Message, nil
+	}
+}
+
+func (self *replayer) record(hop Hop, route string, method string, result json.RawMessage, err error) {
+	message := ReplayedMessage{Hop: hop, Route: route, Kind: "response", Method: method, Message: normalizeJson(result)}
+	if err != nil {
+		message.Kind = "error"
+		message.Error = err.Error()
+		message.Message = nil
+	}
+	self.append(message)
+}
+
+func (self *replayer) append(message ReplayedMessage) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.output = append(self.output, message)
+}
+
+func (self *replayer) count(hop Hop, method string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	count := 0
+	for _, message := range self.output {
+		if message.Hop == hop && message.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// Re-encodes the JSON so the keys are sorted and golden files don't depend on how something was written
+func normalizeJson(message json.RawMessage) json.RawMessage {
+	if len(message) == 0 {
+		return nil
+	}
+	var value any
+	if err := json.Unmarshal(message, &value); err != nil {
+		return message
+	}
+	normalized, err := json.Marshal(value)
+	if err != nil {
+		return message
+	}
+	return normalized
+}
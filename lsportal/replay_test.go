@@ -0,0 +1,113 @@
+package lsportal
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the replay tests")
+
+// Replays every recording in testdata/replay, comparing what lsportal sent with <recording>.golden
+func TestReplayRecordings(t *testing.T) {
+	recordings, _ := filepath.Glob("testdata/replay/*.jsonl")
+	if len(recordings) == 0 {
+		t.Fatal("Expected recordings in testdata/replay")
+	}
+	for _, path := range recordings {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".jsonl"), func(t *testing.T) {
+			recording, err := ReadRecording(path)
+			if err != nil {
+				t.Fatalf("Failed to read the recording: %v", err)
+			}
+			replayed, err := Replay(recording)
+			if err != nil {
+				t.Fatalf("Failed to replay: %v", err)
+			}
+			var got bytes.Buffer
+			encoder := json.NewEncoder(&got)
+			encoder.SetEscapeHTML(false)
+			for _, message := range replayed {
+				encoder.Encode(message)
+			}
+
+			golden := strings.TrimSuffix(path, ".jsonl") + ".golden"
+			if *update {
+				os.WriteFile(golden, got.Bytes(), 0644)
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Failed to read %s, run with -update to create it: %v", golden, err)
+			}
+			if got.String() != string(expected) {
+				t.Errorf("Replay of %s doesn't match %s\nGot:\n%s\nWant:\n%s", path, golden, got.String(), expected)
+			}
+		})
+	}
+}
+
+func TestReplayRoutes(t *testing.T) {
+	regex := `h\((?P<html>.*?)\)|c\((?P<css>.*?)\)`
+	routes := []Route{
+		{Isolation: Isolation{Regex: regex}, Extension: "html"},
+		{Name: "css", Isolation: Isolation{Regex: regex}, Extension: "css"},
+	}
+	path := filepath.Join(t.TempDir(), "routes.jsonl")
+	tracer, err := OpenTrace(path)
+	if err != nil {
+		t.Fatalf("Failed to open the trace: %v", err)
+	}
+	tracer.RecordSetup(routes)
+	fromClient, inclusions, servers := serveRoutes(t, routes...)
+	for i, inclusion := range inclusions {
+		inclusion.Trace(tracer)
+		extension := inclusion.Route.Extension
+		servers[i].OnHover(func(params protocol.HoverParams) *protocol.Hover {
+			return &protocol.Hover{Contents: extension}
+		})
+	}
+	client := connectClient(t, fromClient)
+	client.DidOpen("file:///a.go", "go", "h(<p>) c(p{})")
+	for _, character := range []protocol.UInteger{3, 10} {
+		if _, err := client.Hover("file:///a.go", 0, character); err != nil {
+			t.Fatalf("Failed to hover: %v", err)
+		}
+	}
+	client.Close()
+	tracer.Close()
+
+	recording, err := ReadRecording(path)
+	if err != nil {
+		t.Fatalf("Failed to read the recording: %v", err)
+	}
+	if len(recording.Setup.Routes) != len(routes) {
+		t.Fatalf("Expected every route in the setup, Got: %v", recording.Setup)
+	}
+	replayed, err := Replay(recording)
+	if err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	opened := map[string]int{}
+	var hovers []string
+	for _, message := range replayed {
+		switch {
+		case message.Hop == HopPortalToInner && message.Method == protocol.MethodTextDocumentDidOpen:
+			opened[message.Route]++
+		case message.Hop == HopPortalToClient && message.Method == protocol.MethodTextDocumentHover:
+			hovers = append(hovers, string(message.Message))
+		}
+	}
+	if expected := map[string]int{"": 1, "css": 1}; !reflect.DeepEqual(opened, expected) {
+		t.Errorf("Expected the document opened once on every route: %v, Got: %v", expected, opened)
+	}
+	if expected := []string{`{"contents":"html"}`, `{"contents":"css"}`}; !reflect.DeepEqual(hovers, expected) {
+		t.Errorf("Expected each hover answered by its own route: %v, Got: %v", expected, hovers)
+	}
+}
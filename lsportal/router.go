@@ -0,0 +1,196 @@
+package lsportal
+
+// The router sits in front of the forwarders when inclusions go to more than one inclusion server.
+// Notifications go to every server, requests about a position go to the server owning the inclusion at that position
+// and anything else is asked of every server with the results merged.
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/tliron/commonlog"
+	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
+)
+
+type RouterHandler struct {
+	logger commonlog.Logger
+	// The first route is the default one
+	routes    []routeHandler
+	lifecycle *Lifecycle
+
+	lock sync.Mutex
+	// What the client was told the servers can do, see [RouterHandler.announce]
+	capabilities map[string]any
+}
+
+type routeHandler struct {
+	forwarder   *ForwarderHandler
+	transformer *FromClientTransformer
+}
+
+// Proves that RouterHandler implements glsp.Handler
+var _ glsp.Handler = &RouterHandler{}
+
+// ([glsp.Handler] interface)
+func (self *RouterHandler) Handle(context *glsp.Context) (r any, validMethod bool, validParams bool, err error) {
+	switch context.Method {
+	case MethodShutdown:
+		self.lifecycle.shuttingDown()
+		// Whatever the inclusion servers say we are shutting down, and the client has to be able to send exit
+		if _, _, _, err := self.route(context); err != nil {
+			self.logger.Warningf("error shutting down inclusion servers: %v", err)
+		}
+		return nil, true, true, nil
+	case MethodExit:
+		self.lifecycle.exit()
+		return nil, true, true, nil
+	case MethodInitialize:
+		r, validMethod, validParams, err := self.route(context)
+		if err == nil {
+			self.announce(r)
+		}
+		return r, validMethod, validParams, err
+	}
+	return self.route(context)
+}
+
+// Hands the message to the routes that should see it
+func (self *RouterHandler) route(context *glsp.Context) (any, bool, bool, error) {
+	if len(self.routes) == 1 {
+		return self.routes[0].forwarder.Handle(context)
+	}
+
+	if context.Notification {
+		for _, route := range self.routes {
+			// Each transformer rewrites the params, so every route needs its own copy of the context
+			routeContext := *context
+			route.forwarder.Handle(&routeContext)
+		}
+		return nil, true, true, nil
+	}
+
+	if route, ok := self.routeByTag(context); ok {
+		return route.forwarder.Handle(context)
+	}
+	if route, ok := self.routeByPosition(context); ok {
+		return route.forwarder.Handle(context)
+	}
+	return self.broadcast(context)
+}
+
+// Finds the route that handed out what is being resolved, asking every route would merge its answers into one
+func (self *RouterHandler) routeByTag(context *glsp.Context) (routeHandler, bool) {
+	if context.Method != MethodInlayHintResolve && context.Method != MethodCodeActionResolve {
+		return routeHandler{}, false
+	}
+	if name, ok := taggedRoute(context.Params); ok {
+		for _, route := range self.routes {
+			if route.forwarder.route == name {
+				return route, true
+			}
+		}
+	}
+	// Not ours, the default route turns it down
+	return self.routes[0], true
+}
+
+// Finds the route with an inclusion at the position the request is about
+func (self *RouterHandler) routeByPosition(context *glsp.Context) (routeHandler, bool) {
+	var params struct {
+		TextDocument *TextDocumentIdentifier `json:"textDocument"`
+		Position     *Position               `json:"position"`
+	}
+	if err := json.Unmarshal(context.Params, &params); err != nil || params.TextDocument == nil || params.Position == nil {
+		return routeHandler{}, false
+	}
+	for _, route := range self.routes {
+		if route.transformer.ownsPosition(params.TextDocument.URI, *params.Position) {
+			return route, true
+		}
+	}
+	// Nobody owns the position, let the default route decide what to do with it
+	return self.routes[0], true
+}
+
+// Sends the request to every route, merging the results of the ones that answered
+func (self *RouterHandler) broadcast(context *glsp.Context) (any, bool, bool, error) {
+	type result struct {
+		r   any
+		err error
+	}
+	results := make([]result, len(self.routes))
+	var wg sync.WaitGroup
+	for i, route := range self.routes {
+		wg.Add(1)
+		go func(i int, route routeHandler, routeContext glsp.Context) {
+			defer wg.Done()
+			r, _, _, err := route.forwarder.Handle(&routeContext)
+			results[i] = result{r, err}
+		}(i, route, *context)
+	}
+	wg.Wait()
+
+	merge := mergeResults
+	if isSemanticTokensMethod(context.Method) {
+		merge = mergeSemanticTokens
+	}
+	var merged any
+	var firstErr error
+	answered := false
+	for _, result := range results {
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
+		}
+		if !answered {
+			merged = result.r
+			answered = true
+			continue
+		}
+		merged = merge(merged, result.r)
+	}
+	if !answered {
+		return nil, true, true, firstErr
+	}
+	if firstErr != nil {
+		self.logger.Warningf("%s failed on some inclusion servers: %v", context.Method, firstErr)
+	}
+	return merged, true, true, nil
+}
+
+// Merges the results of the same request from two servers, lists are joined and objects are merged with the first
+// server winning any conflicts. This also merges the capabilities from initialize
+func mergeResults(first any, second any) any {
+	first, second = derefResult(first), derefResult(second)
+	switch firstValue := first.(type) {
+	case nil:
+		return second
+	case []any:
+		if secondValue, ok := second.([]any); ok {
+			return append(firstValue, secondValue...)
+		}
+	case map[string]any:
+		if secondValue, ok := second.(map[string]any); ok {
+			for key, value := range secondValue {
+				if existing, ok := firstValue[key]; ok {
+					firstValue[key] = mergeResults(existing, value)
+				} else {
+					firstValue[key] = value
+				}
+			}
+			return firstValue
+		}
+	}
+	return first
+}
+
+// Forwarders hand back a pointer to the result
+func derefResult(value any) any {
+	if pointer, ok := value.(*any); ok && pointer != nil {
+		return *pointer
+	}
+	return value
+}
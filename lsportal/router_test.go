@@ -0,0 +1,88 @@
+package lsportal
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestRouteByPosition(t *testing.T) {
+	regex := `h\((?P<html>.*?)\)|c\((?P<css>.*?)\)`
+	routes := []Route{
+		{Isolation: Isolation{Regex: regex}, Extension: "html"},
+		{Name: "css", Isolation: Isolation{Regex: regex}, Extension: "css"},
+	}
+	router := RouterHandler{}
+	for _, route := range routes {
+		trans := NewFromClientTransformer(regex, "", route.Extension)
+		trans.setIsolation(route.isolation(routes))
+		router.routes = append(router.routes, routeHandler{transformer: &trans})
+	}
+	for _, route := range router.routes {
+		route.transformer.TransformRequest(&glsp.Context{
+			Method: protocol.MethodTextDocumentDidOpen,
+			Params: []byte(`{"textDocument": {"uri": "file:///a.go", "text": "h(<p>) c(p{})"}}`),
+		})
+	}
+
+	testCases := []struct {
+		character int
+		extension string
+	}{
+		{character: 3, extension: "html"},
+		{character: 10, extension: "css"},
+	}
+	for _, tc := range testCases {
+		context := &glsp.Context{
+			Method: protocol.MethodTextDocumentHover,
+			Params: []byte(fmt.Sprintf(`{"textDocument": {"uri": "file:///a.go"}, "position": {"line": 0, "character": %d}}`, tc.character)),
+		}
+		route, ok := router.routeByPosition(context)
+		if !ok {
+			t.Fatalf("Expected character %d to be routed", tc.character)
+		}
+		if route.transformer.Extension != tc.extension {
+			t.Errorf("Expected character %d to route to %s, Got: %v", tc.character, tc.extension, route.transformer.Extension)
+		}
+	}
+}
+
+func TestRouteByTag(t *testing.T) {
+	router := RouterHandler{routes: []routeHandler{{forwarder: &ForwarderHandler{}}, {forwarder: &ForwarderHandler{route: "css"}}}}
+	testCases := []struct {
+		params string
+		route  string
+	}{
+		{params: `{"label": "x", "data": {"lsportalUri": "file:///a.go", "lsportalRoute": "css", "data": 1}}`, route: "css"},
+		{params: `{"label": "x", "data": {"lsportalUri": "file:///a.go", "lsportalRoute": ""}}`, route: ""},
+		{params: `{"label": "x", "data": 1}`, route: ""},
+	}
+	for _, tc := range testCases {
+		route, ok := router.routeByTag(&glsp.Context{Method: MethodInlayHintResolve, Params: []byte(tc.params)})
+		if !ok || route.forwarder.route != tc.route {
+			t.Errorf("Expected %s to go to route %q, Got: %q", tc.params, tc.route, route.forwarder.route)
+		}
+	}
+	if _, ok := router.routeByTag(&glsp.Context{Method: protocol.MethodTextDocumentHover, Params: []byte(`{}`)}); ok {
+		t.Errorf("Expected only resolve requests to be routed by their tag")
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	first := any(map[string]any{"capabilities": map[string]any{"hoverProvider": true}})
+	second := any(map[string]any{"capabilities": map[string]any{"hoverProvider": false, "colorProvider": true}})
+	merged := mergeResults(&first, &second)
+
+	expected := map[string]any{"capabilities": map[string]any{"hoverProvider": true, "colorProvider": true}}
+	if !reflect.DeepEqual(expected, merged) {
+		t.Errorf("Expected: %v, Got: %v", expected, merged)
+	}
+
+	list := mergeResults([]any{1.0}, []any{2.0})
+	if !reflect.DeepEqual([]any{1.0, 2.0}, list) {
+		t.Errorf("Expected lists to be joined, Got: %v", list)
+	}
+}
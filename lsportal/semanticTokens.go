@@ -0,0 +1,286 @@
+package lsportal
+
+// Semantic tokens come as one flat array of integers relative to the token before, which the position walker can't
+// make sense of. We decode them to absolute positions, drop the ones outside inclusions, move the rest into the host
+// document and renumber their types and modifiers from the inner server's legend to the one the client advertised, so
+// the tokens of every route share a legend and can be merged.
+// Delta responses are applied to the last tokens the inner server sent and handed to the client as full results.
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
+)
+
+type semanticToken struct {
+	line, start, length, tokenType, modifiers uint32
+}
+
+type semanticLegend struct {
+	TokenTypes     []string `json:"tokenTypes"`
+	TokenModifiers []string `json:"tokenModifiers"`
+}
+
+// SemanticTokens or SemanticTokensDelta, deltas have edits instead of data
+type semanticTokensResult struct {
+	ResultID string               `json:"resultId,omitempty"`
+	Data     []uint32             `json:"data"`
+	Edits    []semanticTokensEdit `json:"edits,omitempty"`
+}
+
+type semanticTokensEdit struct {
+	Start       int      `json:"start"`
+	DeleteCount int      `json:"deleteCount"`
+	Data        []uint32 `json:"data"`
+}
+
+type semanticTokensState struct {
+	lock sync.Mutex
+	// Nil until initialize told us
+	clientLegend *semanticLegend
+	innerLegend  *semanticLegend
+	// The last tokens the inner server sent for each host document, to apply its deltas to
+	last map[string]semanticTokensResult
+}
+
+func isSemanticTokensMethod(method string) bool {
+	switch method {
+	case MethodTextDocumentSemanticTokensFull, MethodTextDocumentSemanticTokensFullDelta, MethodTextDocumentSemanticTokensRange:
+		return true
+	}
+	return false
+}
+
+// Remembers the token types and modifiers the client understands, from the initialize params
+func (self *semanticTokensState) rememberClientLegend(params json.RawMessage) {
+	var initialize struct {
+		Capabilities struct {
+			TextDocument struct {
+				SemanticTokens *semanticLegend `json:"semanticTokens"`
+			} `json:"textDocument"`
+		} `json:"capabilities"`
+	}
+	if err := json.Unmarshal(params, &initialize); err != nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.clientLegend = initialize.Capabilities.TextDocument.SemanticTokens
+}
+
+// Remembers the inner server's legend from its initialize result and advertises the client's instead
+func (self *semanticTokensState) translateLegend(result any) {
+	initialize, _ := derefResult(result).(map[string]any)
+	capabilities, _ := initialize["capabilities"].(map[string]any)
+	provider, ok := capabilities["semanticTokensProvider"].(map[string]any)
+	if !ok {
+		return
+	}
+	var legend semanticLegend
+	if !remarshal(provider["legend"], &legend) {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.innerLegend = &legend
+	if self.clientLegend != nil {
+		provider["legend"] = map[string]any{"tokenTypes": self.clientLegend.TokenTypes, "tokenModifiers": self.clientLegend.TokenModifiers}
+	}
+}
+
+// Transforms the result of a semantic tokens request for the document, the context holds the request as it was
+// forwarded. Call with the transformer locked
+func (trans *FromClientTransformer) transformSemanticTokens(context *glsp.Context, response *any) {
+	var params struct {
+		TextDocument     TextDocumentIdentifier `json:"textDocument"`
+		PreviousResultID string                 `json:"previousResultId"`
+	}
+	var result semanticTokensResult
+	if json.Unmarshal(context.Params, &params) != nil || !remarshal(derefResult(*response), &result) {
+		*response = nil
+		return
+	}
+	uri := trans.UriMap[params.TextDocument.URI]
+	doc, ok := trans.Documents[uri]
+	if !ok {
+		*response = nil
+		return
+	}
+
+	state := &trans.semanticTokens
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if result.Edits != nil {
+		last, ok := state.last[uri]
+		if !ok || last.ResultID != params.PreviousResultID {
+			// We can't tell what changed, the client will ask for everything again
+			*response = nil
+			return
+		}
+		result.Data = applySemanticTokensEdits(last.Data, result.Edits)
+		result.Edits = nil
+	}
+	if context.Method != MethodTextDocumentSemanticTokensRange {
+		if state.last == nil {
+			state.last = map[string]semanticTokensResult{}
+		}
+		state.last[uri] = semanticTokensResult{ResultID: result.ResultID, Data: result.Data}
+	}
+
+	typeMap, modifierMap := legendMapping(state.innerLegend, state.clientLegend)
+	var tokens []semanticToken
+	for _, token := range decodeSemanticTokens(result.Data) {
+		token, ok := moveSemanticToken(token, &doc)
+		if !ok {
+			continue
+		}
+		if token.tokenType, ok = mapTokenType(token.tokenType, typeMap); !ok {
+			continue
+		}
+		token.modifiers = mapTokenModifiers(token.modifiers, modifierMap)
+		tokens = append(tokens, token)
+	}
+	*response = semanticTokensResult{ResultID: result.ResultID, Data: encodeSemanticTokens(tokens)}
+}
+
+// Moves a token of the virtual document into the host, tokens that don't lie within an inclusion have nowhere to go
+func moveSemanticToken(token semanticToken, doc *TextDocument) (semanticToken, bool) {
+	start, ok := doc.SourceMap.ToHost(Position{Line: token.line, Character: token.start})
+	if !ok {
+		return token, false
+	}
+	end, ok := doc.SourceMap.ToHost(Position{Line: token.line, Character: token.start + token.length})
+	if !ok || end.Line != start.Line || end.Character < start.Character {
+		return token, false
+	}
+	for _, inclusion := range doc.Inclusions {
+		if isInRange(inclusion, start) && isInRange(inclusion, end) {
+			token.line, token.start, token.length = start.Line, start.Character, end.Character-start.Character
+			return token, true
+		}
+	}
+	return token, false
+}
+
+// For every index of the inner legend, the index in the client's or -1 if the client doesn't know it.
+// Without both legends indices are kept as they are
+func legendMapping(inner *semanticLegend, client *semanticLegend) ([]int, []int) {
+	if inner == nil || client == nil {
+		return nil, nil
+	}
+	return indexMapping(inner.TokenTypes, client.TokenTypes), indexMapping(inner.TokenModifiers, client.TokenModifiers)
+}
+
+func indexMapping(from []string, to []string) []int {
+	indices := map[string]int{}
+	for i, name := range to {
+		indices[name] = i
+	}
+	mapping := make([]int, len(from))
+	for i, name := range from {
+		mapping[i] = -1
+		if index, ok := indices[name]; ok {
+			mapping[i] = index
+		}
+	}
+	return mapping
+}
+
+func mapTokenType(tokenType uint32, typeMap []int) (uint32, bool) {
+	if typeMap == nil {
+		return tokenType, true
+	}
+	if int(tokenType) >= len(typeMap) || typeMap[tokenType] < 0 {
+		return 0, false
+	}
+	return uint32(typeMap[tokenType]), true
+}
+
+// Modifiers the client doesn't know are dropped
+func mapTokenModifiers(modifiers uint32, modifierMap []int) uint32 {
+	if modifierMap == nil {
+		return modifiers
+	}
+	var mapped uint32
+	for bit := 0; bit < len(modifierMap) && bit < 32; bit++ {
+		if modifiers&(1<<bit) != 0 && modifierMap[bit] >= 0 {
+			mapped |= 1 << modifierMap[bit]
+		}
+	}
+	return mapped
+}
+
+func decodeSemanticTokens(data []uint32) []semanticToken {
+	var tokens []semanticToken
+	var line, start uint32
+	for i := 0; i+4 < len(data); i += 5 {
+		if data[i] > 0 {
+			line += data[i]
+			start = 0
+		}
+		start += data[i+1]
+		tokens = append(tokens, semanticToken{line: line, start: start, length: data[i+2], tokenType: data[i+3], modifiers: data[i+4]})
+	}
+	return tokens
+}
+
+// Sorts the tokens and encodes them relative to each other again
+func encodeSemanticTokens(tokens []semanticToken) []uint32 {
+	sort.SliceStable(tokens, func(i, j int) bool {
+		if tokens[i].line != tokens[j].line {
+			return tokens[i].line < tokens[j].line
+		}
+		return tokens[i].start < tokens[j].start
+	})
+	data := make([]uint32, 0, len(tokens)*5)
+	var line, start uint32
+	for _, token := range tokens {
+		if token.line != line {
+			start = 0
+		}
+		data = append(data, token.line-line, token.start-start, token.length, token.tokenType, token.modifiers)
+		line, start = token.line, token.start
+	}
+	return data
+}
+
+func applySemanticTokensEdits(data []uint32, edits []semanticTokensEdit) []uint32 {
+	// Edits refer to the original array, so apply them back to front
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].Start > edits[j].Start })
+	data = append([]uint32(nil), data...)
+	for _, edit := range edits {
+		start := min(max(edit.Start, 0), len(data))
+		end := min(start+max(edit.DeleteCount, 0), len(data))
+		data = append(data[:start], append(append([]uint32(nil), edit.Data...), data[end:]...)...)
+	}
+	return data
+}
+
+// Merges the semantic tokens of two routes, they share the client's legend. Without a single server behind them the
+// result id means nothing, so the client gets full results every time
+func mergeSemanticTokens(first any, second any) any {
+	var firstResult, secondResult semanticTokensResult
+	if !remarshal(derefResult(first), &firstResult) {
+		return second
+	}
+	if !remarshal(derefResult(second), &secondResult) {
+		return first
+	}
+	tokens := append(decodeSemanticTokens(firstResult.Data), decodeSemanticTokens(secondResult.Data)...)
+	return semanticTokensResult{Data: encodeSemanticTokens(tokens)}
+}
+
+// Converts a decoded json value into value, returning false if it doesn't fit or is null
+func remarshal(from any, value any) bool {
+	if from == nil {
+		return false
+	}
+	bytes, err := json.Marshal(from)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(bytes, value) == nil
+}
@@ -0,0 +1,96 @@
+package lsportal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestSemanticTokensEncoding(t *testing.T) {
+	data := []uint32{0, 2, 3, 0, 0, 0, 4, 1, 1, 2, 2, 1, 5, 0, 0}
+	tokens := decodeSemanticTokens(data)
+	expected := []semanticToken{{0, 2, 3, 0, 0}, {0, 6, 1, 1, 2}, {2, 1, 5, 0, 0}}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Expected: %v, Got: %v", expected, tokens)
+	}
+	if encoded := encodeSemanticTokens(tokens); !reflect.DeepEqual(encoded, data) {
+		t.Errorf("Expected: %v, Got: %v", data, encoded)
+	}
+	edited := applySemanticTokensEdits(data, []semanticTokensEdit{{Start: 5, DeleteCount: 5}, {Start: 15, Data: []uint32{0, 6, 1, 0, 0}}})
+	if expected := []uint32{0, 2, 3, 0, 0, 2, 1, 5, 0, 0, 0, 6, 1, 0, 0}; !reflect.DeepEqual(edited, expected) {
+		t.Errorf("Expected: %v, Got: %v", expected, edited)
+	}
+}
+
+func TestTransformSemanticTokens(t *testing.T) {
+	trans := NewFromClientTransformer(`~([\s\S]*?)~`, "", "html")
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodInitialize,
+		Params: []byte(`{"capabilities": {"textDocument": {"semanticTokens": {"tokenTypes": ["attr", "tag"], "tokenModifiers": ["static"]}}}}`),
+	})
+	var initialize any
+	json.Unmarshal([]byte(`{"capabilities": {"semanticTokensProvider": {"full": {"delta": true}, "legend": {"tokenTypes": ["tag", "attr", "comment"], "tokenModifiers": ["readonly", "static"]}}}}`), &initialize)
+	trans.TransformResponse(&glsp.Context{Method: protocol.MethodInitialize}, &initialize)
+	legend := initialize.(map[string]any)["capabilities"].(map[string]any)["semanticTokensProvider"].(map[string]any)["legend"]
+	if types := legend.(map[string]any)["tokenTypes"]; !reflect.DeepEqual(types, []string{"attr", "tag"}) {
+		t.Errorf("Expected the client its own legend, Got: %v", types)
+	}
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x := ~<p>~\ny ~<b>~"}}`),
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		params   string
+		response string
+		expected string
+	}{
+		{
+			name:   "full drops tokens outside inclusions and translates the legend",
+			method: protocol.MethodTextDocumentSemanticTokensFull,
+			params: `{"textDocument": {"uri": "file:///a.html"}}`,
+			// x, <p> readonly|static, a comment only the inner server knows and <b> static
+			response: `{"resultId": "1", "data": [0, 0, 1, 0, 0, 0, 6, 3, 0, 3, 1, 3, 3, 2, 0, 0, 0, 3, 1, 2]}`,
+			expected: `{"resultId":"1","data":[0,6,3,1,1,1,3,3,0,1]}`,
+		},
+		{
+			name:     "deltas apply to the last full result",
+			method:   protocol.MethodTextDocumentSemanticTokensFullDelta,
+			params:   `{"textDocument": {"uri": "file:///a.html"}, "previousResultId": "1"}`,
+			response: `{"resultId": "2", "edits": [{"start": 5, "deleteCount": 5, "data": [0, 6, 3, 1, 0]}]}`,
+			expected: `{"resultId":"2","data":[0,6,3,0,0,1,3,3,0,1]}`,
+		},
+		{
+			name:     "deltas against a result we don't know are dropped",
+			method:   protocol.MethodTextDocumentSemanticTokensFullDelta,
+			params:   `{"textDocument": {"uri": "file:///a.html"}, "previousResultId": "1"}`,
+			response: `{"resultId": "3", "edits": []}`,
+			expected: `null`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response any
+			json.Unmarshal([]byte(test.response), &response)
+			trans.TransformResponse(&glsp.Context{Method: test.method, Params: []byte(test.params)}, &response)
+			got, _ := json.Marshal(response)
+			if string(got) != test.expected {
+				t.Errorf("Expected: %s, Got: %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestMergeSemanticTokens(t *testing.T) {
+	first := semanticTokensResult{ResultID: "1", Data: []uint32{0, 2, 3, 0, 0, 2, 0, 1, 0, 0}}
+	second := semanticTokensResult{ResultID: "7", Data: []uint32{1, 4, 2, 1, 0}}
+	merged, _ := json.Marshal(mergeSemanticTokens(first, second))
+	if expected := `{"data":[0,2,3,0,0,1,4,2,1,0,1,0,1,0,0]}`; string(merged) != expected {
+		t.Errorf("Expected: %s, Got: %s", expected, merged)
+	}
+}
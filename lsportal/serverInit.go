@@ -5,20 +5,122 @@ import (
 	"github.com/tliron/glsp/server"
 )
 
+// A Route sends the inclusions matched by a named capture group to an inclusion server of their own
+type Route struct {
+	// The named group this route takes, the default route has no name and takes every group no other route does
+	Name      string
+	Isolation Isolation
+	Extension string
+	// Nest the document symbols of every inclusion under a symbol named after the host call around it
+	GroupSymbols bool
+	// Add a folding range of kind region for every inclusion spanning several lines
+	FoldInclusions bool
+}
+
+// An Inclusion is our side of the connection to a single inclusion server
+type Inclusion struct {
+	Route Route
+	// Serves the connection to the inclusion server
+	Server      *server.Server
+	transformer *FromClientTransformer
+	// Forwards what the client sends to the inclusion server
+	fromClient *ForwarderHandler
+	// Forwards what the inclusion server sends to the client
+	toClient *ForwarderHandler
+	// Set once a supervisor runs the inclusion server
+	supervisor *Supervisor
+	router     *RouterHandler
+}
+
 // Connects two servers so that they forward messages between each other
-func InitForwarders(debug bool, regex string, exclusionRegex string, extension string) (*server.Server, *server.Server) {
-	//toInclusion
-	fromClientTrans := NewFromClientTransformer(regex, exclusionRegex, extension)
-	fromClientForwarder := ForwarderHandler{Transformer: &fromClientTrans, logger: commonlog.GetLogger("fromClientForwader")}
-	fromClient := server.NewServer(&fromClientForwarder, "fromCLient", debug)
-
-	//client
-	fromInclusionTrans := FromInclusionTransformer{ServerTransformer: &fromClientTrans}
-	fromInclusionForwarder := ForwarderHandler{Transformer: &fromInclusionTrans, logger: commonlog.GetLogger("fromInclusionForwader")}
-	fromInclusion := server.NewServer(&fromInclusionForwarder, "fromInclusion", debug)
-
-	//connect the two servers so they can send messages in between
-	fromClientForwarder.otherServer = fromInclusion
-	fromInclusionForwarder.otherServer = fromClient
-	return fromClient, fromInclusion
+func InitForwarders(debug bool, isolation Isolation, extension string) (*server.Server, *server.Server) {
+	fromClient, inclusions, _ := InitRoutes(debug, []Route{{Isolation: isolation, Extension: extension}})
+	return fromClient, inclusions[0].Server
+}
+
+// Connects the client to one inclusion server per route, the returned inclusions are in the same order as the routes.
+// The lifecycle knows when the client is done with us, call its Wait once the client connection closes
+func InitRoutes(debug bool, routes []Route) (*server.Server, []*Inclusion, *Lifecycle) {
+	router, inclusions := initRouter(debug, routes)
+	fromClient := server.NewServer(router, "fromCLient", debug)
+	for _, inclusion := range inclusions {
+		inclusion.toClient.otherServer = fromClient
+	}
+	return fromClient, inclusions, router.lifecycle
+}
+
+// Sets up the inclusion side of every route, leaving where the inclusion servers send their messages to the caller
+func initRouter(debug bool, routes []Route) (*RouterHandler, []*Inclusion) {
+	router := &RouterHandler{logger: commonlog.GetLogger("router")}
+	var inclusions []*Inclusion
+	for _, route := range routes {
+		//toInclusion
+		fromClientTrans := NewFromClientTransformer(route.Isolation.Regex, route.Isolation.ExclusionRegex, route.Extension)
+		fromClientTrans.setIsolation(route.isolation(routes))
+		fromClientTrans.GroupSymbols = route.GroupSymbols
+		fromClientTrans.FoldInclusions = route.FoldInclusions
+		fromClientTrans.route = route.Name
+		fromClientForwarder := ForwarderHandler{Transformer: &fromClientTrans, logger: commonlog.GetLogger("fromClientForwader")}
+
+		//client
+		fromInclusionTrans := FromInclusionTransformer{ServerTransformer: &fromClientTrans}
+		fromInclusionForwarder := ForwarderHandler{Transformer: &fromInclusionTrans, logger: commonlog.GetLogger("fromInclusionForwader")}
+		fromInclusion := server.NewServer(&fromInclusionForwarder, route.logName(), debug)
+
+		//connect the two servers so they can send messages in between
+		fromClientForwarder.otherServer = fromInclusion
+		router.routes = append(router.routes, routeHandler{forwarder: &fromClientForwarder, transformer: &fromClientTrans})
+		fromClientForwarder.hops, fromInclusionForwarder.hops = clientHops, inclusionHops
+		fromClientForwarder.route, fromInclusionForwarder.route = route.Name, route.Name
+		inclusion := &Inclusion{Route: route, Server: fromInclusion, transformer: &fromClientTrans, fromClient: &fromClientForwarder, toClient: &fromInclusionForwarder}
+		fromClientForwarder.inclusion = inclusion
+		inclusion.router = router
+		inclusions = append(inclusions, inclusion)
+	}
+	router.lifecycle = newLifecycle(inclusions)
+	return router, inclusions
+}
+
+// Traces the messages to and from the inclusion server, see [Tracer]
+func (inclusion *Inclusion) Trace(tracer *Tracer) {
+	inclusion.fromClient.tracer = tracer
+	inclusion.toClient.tracer = tracer
+}
+
+// Exports spans for the messages to and from the inclusion server, see [SpanExporter]
+func (inclusion *Inclusion) ExportSpans(exporter *SpanExporter) {
+	inclusion.fromClient.spans = exporter
+	inclusion.toClient.spans = exporter
+}
+
+// Measures the messages to and from the inclusion server and the work on its documents, see [Metrics]
+func (inclusion *Inclusion) Measure(metrics *Metrics) {
+	inclusion.fromClient.metrics = metrics
+	inclusion.toClient.metrics = metrics
+	inclusion.transformer.lock.Lock()
+	defer inclusion.transformer.lock.Unlock()
+	inclusion.transformer.metrics = metrics
+	inclusion.transformer.route = inclusion.Route.Name
+}
+
+// The isolation for this route, taking only its own group or leaving the groups of the other routes
+func (route Route) isolation(routes []Route) Isolation {
+	isolation := route.Isolation
+	if route.Name != "" {
+		isolation.Groups = []string{route.Name}
+		return isolation
+	}
+	for _, other := range routes {
+		if other.Name != "" {
+			isolation.SkipGroups = append(isolation.SkipGroups, other.Name)
+		}
+	}
+	return isolation
+}
+
+func (route Route) logName() string {
+	if route.Name == "" {
+		return "fromInclusion"
+	}
+	return "fromInclusion." + route.Name
 }
@@ -64,6 +64,51 @@ func TestInitForwarders(t *testing.T) {
 
 }
 
+func TestRoundTrip(t *testing.T) {
+	fromClient, _, server := serveRoute(t, Route{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"})
+	server.OnHover(func(params protocol.HoverParams) *protocol.Hover {
+		position := params.Position
+		return &protocol.Hover{
+			Contents: protocol.MarkupContent{Kind: protocol.MarkupKindPlainText, Value: params.TextDocument.URI},
+			Range:    &protocol.Range{Start: position, End: protocol.Position{Line: position.Line, Character: position.Character + 1}},
+		}
+	})
+	server.OnCompletion(func(params protocol.CompletionParams) []protocol.CompletionItem {
+		return []protocol.CompletionItem{{Label: "div"}}
+	})
+	client := connectClient(t, fromClient)
+
+	if _, err := client.Initialize("file:///project"); err != nil {
+		t.Fatalf("Failed to initialize: %v", err)
+	}
+	client.DidOpen("file:///project/a.go", "go", "x := 1\ny := ~<p>~")
+	document, err := server.WaitForOpen()
+	if err != nil || document.URI != "file:///project/a.html" || document.Text != "      \n      <p> " {
+		t.Fatalf("Expected the server to see only the inclusion, Got: %q, %v", document, err)
+	}
+
+	hover, err := client.Hover("file:///project/a.go", 1, 7)
+	if err != nil || hover == nil || hover.Range == nil {
+		t.Fatalf("Expected a hover, Got: %v, %v", hover, err)
+	}
+	if hover.Range.Start != (protocol.Position{Line: 1, Character: 7}) {
+		t.Errorf("Expected the hover range in the host document, Got: %v", hover.Range)
+	}
+	items, err := client.Completion("file:///project/a.go", 1, 7)
+	if err != nil || len(items) != 1 || items[0].Label != "div" {
+		t.Errorf("Expected the completion items, Got: %v, %v", items, err)
+	}
+
+	server.PublishDiagnostics("file:///project/a.html", protocol.Diagnostic{
+		Range:   protocol.Range{Start: protocol.Position{Line: 1, Character: 6}, End: protocol.Position{Line: 1, Character: 9}},
+		Message: "unclosed p",
+	})
+	diagnostics, err := client.WaitForDiagnostics("file:///project/a.go")
+	if err != nil || len(diagnostics) != 1 || diagnostics[0].Range.Start.Character != 6 {
+		t.Errorf("Expected the diagnostics for the host document, Got: %v, %v", diagnostics, err)
+	}
+}
+
 func makejsonStreams() (jsonrpc2.ObjectStream, jsonrpc2.ObjectStream) {
 
 	// Create two pairs of pipes for bidirectional communication between the servers
@@ -88,7 +133,7 @@ func makejsonStreams() (jsonrpc2.ObjectStream, jsonrpc2.ObjectStream) {
 // creates two servers, one for the client and one for the inclusion.
 // This allows us to test from both ends of the forwarding logic
 func InitServersWithPipeIO(debug bool, regex string, exclusionRegex string, extension string) (io.ReadWriteCloser, io.ReadWriteCloser, func()) {
-	fromClient, fromInclusion := InitForwarders(debug, regex, exclusionRegex, extension)
+	fromClient, fromInclusion := InitForwarders(debug, Isolation{Regex: regex, ExclusionRegex: exclusionRegex}, extension)
 
 	// Create two pairs of pipes for bidirectional communication between the servers
 	clientWriteO, clientWriteI := io.Pipe()
@@ -97,20 +142,30 @@ func InitServersWithPipeIO(debug bool, regex string, exclusionRegex string, exte
 	inclusionReadO, inclusionReadI := io.Pipe()
 
 	// Start serving the streams on both servers
-	go fromClient.ServeStream(struct {
-		io.Reader
-		io.WriteCloser
-	}{clientWriteO, clientReadI}, nil)
+	served := make(chan struct{}, 2)
+	go func() {
+		ServeStream(fromClient, struct {
+			io.Reader
+			io.WriteCloser
+		}{clientWriteO, clientReadI})
+		served <- struct{}{}
+	}()
 
-	go fromInclusion.ServeStream(struct {
-		io.Reader
-		io.WriteCloser
-	}{inclusionWriteO, inclusionReadI}, nil)
+	go func() {
+		ServeStream(fromInclusion, struct {
+			io.Reader
+			io.WriteCloser
+		}{inclusionWriteO, inclusionReadI})
+		served <- struct{}{}
+	}()
 	closer := func() {
 		clientWriteO.Close()
 		clientReadO.Close()
 		inclusionWriteO.Close()
 		inclusionReadO.Close()
+		// The connections log as they close, which has to happen before the test is over
+		<-served
+		<-served
 	}
 	client := struct {
 		io.Reader
@@ -0,0 +1,291 @@
+package lsportal
+
+// Sharing one set of inclusion servers between several clients, eg: editors connecting to lsportal over a socket.
+// The first client initializes the inclusion servers and everyone after it gets the same answer, so the clients are
+// expected to be alike: eg: the semantic tokens legend is translated to the token types the first client supports.
+// A document is opened in the inclusion servers by the first client to open it and closed by the last to close it.
+// Notifications from the inclusion servers go to the clients with the document open, requests go to the client that
+// connected first. Clients shutting down only end their own connection, the inclusion servers stay up for the rest
+
+import (
+	contextpkg "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tliron/commonlog"
+	"github.com/tliron/glsp"
+	. "github.com/tliron/glsp/protocol_3_16"
+	"github.com/tliron/glsp/server"
+)
+
+type SharedSession struct {
+	logger  commonlog.Logger
+	debug   bool
+	router  *RouterHandler
+	clients *ClientSet
+
+	lock             sync.Mutex
+	initializeResult any
+	initialized      bool
+	nextClient       int
+}
+
+// Connects one inclusion server per route that every client given to Serve shares.
+// The lifecycle only sees exit when lsportal itself is going away, call its Wait then
+func InitSharedRoutes(debug bool, routes []Route) (*SharedSession, []*Inclusion, *Lifecycle) {
+	router, inclusions := initRouter(debug, routes)
+	session := &SharedSession{
+		logger:  commonlog.GetLogger("shared"),
+		debug:   debug,
+		router:  router,
+		clients: &ClientSet{},
+	}
+	for _, inclusion := range inclusions {
+		inclusion.toClient.clients = session.clients
+	}
+	return session, inclusions, router.lifecycle
+}
+
+// Serves a client until it disconnects
+func (self *SharedSession) Serve(stream io.ReadWriteCloser) {
+	self.lock.Lock()
+	self.nextClient++
+	id := self.nextClient
+	self.lock.Unlock()
+
+	client := &sharedClient{documents: map[DocumentUri]bool{}}
+	handler := sharedClientHandler{session: self, client: client}
+	client.server = server.NewServer(&handler, fmt.Sprintf("fromClient.%d", id), self.debug)
+	self.clients.add(client)
+	ServeStream(client.server, stream)
+
+	// Close whatever only this client had open so the inclusion servers don't keep stale documents around
+	for _, uri := range self.clients.remove(client) {
+		params, _ := json.Marshal(DidCloseTextDocumentParams{TextDocument: TextDocumentIdentifier{URI: uri}})
+		self.router.Handle(&glsp.Context{
+			Method:       MethodTextDocumentDidClose,
+			Params:       params,
+			Notification: true,
+			Context:      contextpkg.Background(),
+		})
+	}
+	self.logger.Infof("client %d disconnected", id)
+}
+
+type sharedClientHandler struct {
+	session *SharedSession
+	client  *sharedClient
+}
+
+// Proves that sharedClientHandler implements glsp.Handler
+var _ glsp.Handler = &sharedClientHandler{}
+
+// ([glsp.Handler] interface)
+func (self *sharedClientHandler) Handle(context *glsp.Context) (r any, validMethod bool, validParams bool, err error) {
+	session := self.session
+	switch context.Method {
+	case MethodInitialize:
+		// Holding the lock makes clients connecting at the same time wait for the first initialize
+		session.lock.Lock()
+		defer session.lock.Unlock()
+		if session.initializeResult != nil {
+			return session.initializeResult, true, true, nil
+		}
+		r, validMethod, validParams, err = session.router.Handle(context)
+		if err == nil {
+			session.initializeResult = r
+		}
+		return r, validMethod, validParams, err
+	case MethodInitialized:
+		session.lock.Lock()
+		initialized := session.initialized
+		session.initialized = true
+		session.lock.Unlock()
+		if initialized {
+			return nil, true, true, nil
+		}
+	case MethodShutdown, MethodExit:
+		// The other clients still need the inclusion servers
+		return nil, true, true, nil
+	case MethodTextDocumentDidOpen:
+		// Another client has it open already, opening it again would start the document over in the inclusion servers
+		if uri, ok := documentUri(context.Params); ok && !session.clients.opened(self.client, uri) {
+			return nil, true, true, nil
+		}
+	case MethodTextDocumentDidClose:
+		if uri, ok := documentUri(context.Params); ok && !session.clients.closed(self.client, uri) {
+			return nil, true, true, nil
+		}
+	}
+	return session.router.Handle(context)
+}
+
+func documentUri(params json.RawMessage) (DocumentUri, bool) {
+	var document struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+	}
+	if err := json.Unmarshal(params, &document); err != nil || document.TextDocument.URI == "" {
+		return "", false
+	}
+	return document.TextDocument.URI, true
+}
+
+// The clients sharing the inclusion servers and the documents each of them has open
+type ClientSet struct {
+	lock    sync.Mutex
+	clients []*sharedClient
+}
+
+type sharedClient struct {
+	server    *server.Server
+	documents map[DocumentUri]bool
+}
+
+func (self *sharedClient) notify(ctx contextpkg.Context, method string, params any) error {
+	// The client connected but we haven't started serving it yet
+	connection := connectionOf(self.server)
+	if connection == nil {
+		return nil
+	}
+	return connection.Notify(ctx, method, params)
+}
+
+func (self *ClientSet) add(client *sharedClient) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.clients = append(self.clients, client)
+}
+
+// Removes the client, returning the documents no other client has open
+func (self *ClientSet) remove(client *sharedClient) []DocumentUri {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, other := range self.clients {
+		if other == client {
+			self.clients = append(self.clients[:i], self.clients[i+1:]...)
+			break
+		}
+	}
+	var orphans []DocumentUri
+	for uri := range client.documents {
+		if !self.isOpen(uri) {
+			orphans = append(orphans, uri)
+		}
+	}
+	return orphans
+}
+
+// Records the client opening the document, returns true if no client had it open yet
+func (self *ClientSet) opened(client *sharedClient, uri DocumentUri) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	first := !self.isOpen(uri)
+	client.documents[uri] = true
+	return first
+}
+
+// Records the client closing the document, returns true if no client has it open anymore
+func (self *ClientSet) closed(client *sharedClient, uri DocumentUri) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(client.documents, uri)
+	return !self.isOpen(uri)
+}
+
+func (self *ClientSet) isOpen(uri DocumentUri) bool {
+	for _, client := range self.clients {
+		if client.documents[uri] {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends a message from an inclusion server to the clients it concerns
+func (self *ClientSet) forward(ctx contextpkg.Context, context *glsp.Context) (*any, error) {
+	var res any
+	if !context.Notification {
+		client := self.first()
+		if client == nil {
+			return nil, errors.New("no client connected")
+		}
+		connection := connectionOf(client.server)
+		if connection == nil {
+			return nil, errors.New("no client connected")
+		}
+		err := connection.Call(ctx, context.Method, context.Params, &res)
+		if err != nil {
+			return nil, err
+		}
+		return &res, nil
+	}
+
+	targets := self.all()
+	if uri, ok := diagnosticsUri(context); ok {
+		targets = self.withDocument(uri)
+	}
+	var firstErr error
+	for _, client := range targets {
+		if err := client.notify(ctx, context.Method, context.Params); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return &res, nil
+}
+
+// Sends a notification to every client
+func (self *ClientSet) notify(ctx contextpkg.Context, method string, params any) error {
+	var firstErr error
+	for _, client := range self.all() {
+		if err := client.notify(ctx, method, params); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func diagnosticsUri(context *glsp.Context) (DocumentUri, bool) {
+	if context.Method != ServerTextDocumentPublishDiagnostics {
+		return "", false
+	}
+	var params struct {
+		URI DocumentUri `json:"uri"`
+	}
+	if err := json.Unmarshal(context.Params, &params); err != nil {
+		return "", false
+	}
+	return params.URI, true
+}
+
+func (self *ClientSet) first() *sharedClient {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.clients) == 0 {
+		return nil
+	}
+	return self.clients[0]
+}
+
+func (self *ClientSet) all() []*sharedClient {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*sharedClient(nil), self.clients...)
+}
+
+func (self *ClientSet) withDocument(uri DocumentUri) []*sharedClient {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var clients []*sharedClient
+	for _, client := range self.clients {
+		if client.documents[uri] {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,101 @@
+package lsportal
+
+import (
+	contextpkg "context"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func newTestConn(stream net.Conn, handle func(conn *jsonrpc2.Conn, req *jsonrpc2.Request) any) *jsonrpc2.Conn {
+	return jsonrpc2.NewConn(contextpkg.Background(), jsonrpc2.NewBufferedStream(stream, jsonrpc2.VSCodeObjectCodec{}),
+		jsonrpc2.HandlerWithError(func(ctx contextpkg.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+			return handle(conn, req), nil
+		}))
+}
+
+func TestSharedSession(t *testing.T) {
+	session, inclusions, _ := InitSharedRoutes(false, []Route{{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"}})
+
+	var initializeCount, openCount atomic.Int32
+	innerSide, portalSide := net.Pipe()
+	go ServeStream(inclusions[0].Server, portalSide)
+	newTestConn(innerSide, func(conn *jsonrpc2.Conn, req *jsonrpc2.Request) any {
+		switch req.Method {
+		case protocol.MethodInitialize:
+			initializeCount.Add(1)
+			return map[string]any{"capabilities": map[string]any{}}
+		case protocol.MethodTextDocumentDidOpen:
+			openCount.Add(1)
+			var params protocol.DidOpenTextDocumentParams
+			json.Unmarshal(*req.Params, &params)
+			go conn.Notify(contextpkg.Background(), protocol.ServerTextDocumentPublishDiagnostics,
+				protocol.PublishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []protocol.Diagnostic{}})
+		}
+		return nil
+	})
+
+	var clients []*jsonrpc2.Conn
+	var diagnostics []chan string
+	for i := 0; i < 2; i++ {
+		received := make(chan string, 10)
+		clientSide, portalSide := net.Pipe()
+		go session.Serve(portalSide)
+		clients = append(clients, newTestConn(clientSide, func(conn *jsonrpc2.Conn, req *jsonrpc2.Request) any {
+			if req.Method == protocol.ServerTextDocumentPublishDiagnostics {
+				var params protocol.PublishDiagnosticsParams
+				json.Unmarshal(*req.Params, &params)
+				received <- params.URI
+			}
+			return nil
+		}))
+		diagnostics = append(diagnostics, received)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := contextpkg.WithTimeout(contextpkg.Background(), 5*time.Second)
+	defer cancel()
+	for i, client := range clients {
+		var result map[string]any
+		if err := client.Call(ctx, protocol.MethodInitialize, map[string]any{"processId": nil}, &result); err != nil {
+			t.Fatalf("Client %d failed to initialize: %v", i, err)
+		}
+		if _, ok := result["capabilities"]; !ok {
+			t.Errorf("Expected client %d to get the capabilities, Got: %v", i, result)
+		}
+	}
+	if count := initializeCount.Load(); count != 1 {
+		t.Errorf("Expected the inclusion server to be initialized once, Got: %d", count)
+	}
+
+	clients[1].Notify(ctx, protocol.MethodTextDocumentDidOpen, protocol.DidOpenTextDocumentParams{
+		TextDocument: protocol.TextDocumentItem{URI: "file:///b.go", LanguageID: "go", Version: 1, Text: "x ~<p>~"},
+	})
+	select {
+	case uri := <-diagnostics[1]:
+		if uri != "file:///b.go" {
+			t.Errorf("Expected diagnostics for file:///b.go, Got: %s", uri)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the client that opened the document to get its diagnostics")
+	}
+	select {
+	case uri := <-diagnostics[0]:
+		t.Errorf("Expected the other client not to get diagnostics, Got: %s", uri)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The other client opening the document too leaves the inclusion server's copy alone
+	clients[0].Notify(ctx, protocol.MethodTextDocumentDidOpen, protocol.DidOpenTextDocumentParams{
+		TextDocument: protocol.TextDocumentItem{URI: "file:///b.go", LanguageID: "go", Version: 1, Text: "x ~<p>~"},
+	})
+	time.Sleep(100 * time.Millisecond)
+	if count := openCount.Load(); count != 1 {
+		t.Errorf("Expected the document to be opened in the inclusion server once, Got: %d", count)
+	}
+}
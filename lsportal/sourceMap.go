@@ -0,0 +1,182 @@
+package lsportal
+
+import (
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+// A SourceMap records how the virtual document we send to the inclusion server lines up with the host document.
+// The virtual document is built from segments, each either copied from the host (1:1), injected text the host never had
+// or a placeholder standing in for host text.
+// The zero value is the identity map, which is what we get when nothing is injected.
+type SourceMap struct {
+	segments        []mapSegment
+	hostLineEnds    []int
+	virtualLineEnds []int
+	hostLength      int
+	virtualLength   int
+}
+
+type segmentKind int
+
+const (
+	// Text copied or blanked from the host, offsets line up one to one
+	segmentMapped segmentKind = iota
+	// Text that only exists in the virtual document, eg: an inclusion prefix
+	segmentInjected
+	// Text that stands in for different host text, eg: an exclusion placeholder. Only its edges can be mapped
+	segmentOpaque
+)
+
+// All offsets are rune offsets, start inclusive, end exclusive
+type mapSegment struct {
+	kind         segmentKind
+	hostStart    int
+	hostEnd      int
+	virtualStart int
+	virtualEnd   int
+	// Whether this segment is the content of an inclusion, used to pick a side when positions sit on a boundary
+	inclusion bool
+}
+
+// Maps a position in the host document to the virtual document
+func (m *SourceMap) ToVirtual(pos protocol.Position) (protocol.Position, bool) {
+	if m == nil || len(m.segments) == 0 {
+		return pos, true
+	}
+	offset := getOffset(pos, m.hostLineEnds, m.hostLength)
+	var found *mapSegment
+	for i := range m.segments {
+		seg := &m.segments[i]
+		if seg.kind != segmentMapped || offset < seg.hostStart || offset > seg.hostEnd {
+			continue
+		}
+		// A position right between an inclusion and injected text belongs to the inclusion,
+		// so the start of an inclusion lands after its prefix and the end lands before its suffix
+		if found == nil || (seg.inclusion && !found.inclusion) {
+			found = seg
+		}
+	}
+	if found == nil {
+		return pos, false
+	}
+	return getPosition(found.virtualStart+offset-found.hostStart, m.virtualLineEnds), true
+}
+
+// Maps a position in the virtual document back to the host document.
+// Positions inside injected text have nowhere to go and return false
+func (m *SourceMap) ToHost(pos protocol.Position) (protocol.Position, bool) {
+	if m == nil || len(m.segments) == 0 {
+		return pos, true
+	}
+	offset := getOffset(pos, m.virtualLineEnds, m.virtualLength)
+	for _, seg := range m.segments {
+		if seg.kind == segmentMapped && offset >= seg.virtualStart && offset <= seg.virtualEnd {
+			return getPosition(seg.hostStart+offset-seg.virtualStart, m.hostLineEnds), true
+		}
+	}
+	return pos, false
+}
+
+// Checks that an edit of the virtual range only touches text copied from the host.
+// Edits to injected text or placeholders would write text into the host that was never there
+func (m *SourceMap) EditableInVirtual(r protocol.Range) bool {
+	if m == nil || len(m.segments) == 0 {
+		return true
+	}
+	start, end := getOffset(r.Start, m.virtualLineEnds, m.virtualLength), getOffset(r.End, m.virtualLineEnds, m.virtualLength)
+	for _, seg := range m.segments {
+		if seg.kind == segmentMapped {
+			continue
+		}
+		if start < seg.virtualEnd && end > seg.virtualStart {
+			return false
+		}
+	}
+	return true
+}
+
+// Maps a range in the virtual document back to the host document, both ends must be mappable.
+// A range overlapping injected text can't be mapped either: its ends would land next to each other, eg: an edit of the
+// prefix becoming an insert, or the host would get the injected text, eg: an edit running into the suffix
+func (m *SourceMap) RangeToHost(r protocol.Range) (protocol.Range, bool) {
+	if m.overlapsInjected(r) {
+		return r, false
+	}
+	start, ok := m.ToHost(r.Start)
+	if !ok {
+		return r, false
+	}
+	end, ok := m.ToHost(r.End)
+	if !ok {
+		return r, false
+	}
+	return protocol.Range{Start: start, End: end}, true
+}
+
+func (m *SourceMap) overlapsInjected(r protocol.Range) bool {
+	if m == nil || len(m.segments) == 0 {
+		return false
+	}
+	start, end := getOffset(r.Start, m.virtualLineEnds, m.virtualLength), getOffset(r.End, m.virtualLineEnds, m.virtualLength)
+	for _, seg := range m.segments {
+		if seg.kind == segmentInjected && start < seg.virtualEnd && end > seg.virtualStart {
+			return true
+		}
+	}
+	return false
+}
+
+// Maps a range in the host document to the virtual document, both ends must be mappable
+func (m *SourceMap) RangeToVirtual(r protocol.Range) (protocol.Range, bool) {
+	start, ok := m.ToVirtual(r.Start)
+	if !ok {
+		return r, false
+	}
+	end, ok := m.ToVirtual(r.End)
+	if !ok {
+		return r, false
+	}
+	return protocol.Range{Start: start, End: end}, true
+}
+
+// The inverse of getPosition, characters past the end of a line are clamped to the line end
+// and positions past the last line to the end of the text
+func getOffset(pos protocol.Position, lineEnds []int, length int) int {
+	line := int(pos.Line)
+	if line > len(lineEnds) {
+		return length
+	}
+	lineStart := 0
+	if line > 0 {
+		lineStart = lineEnds[line-1] + 1
+	}
+	offset := lineStart + int(pos.Character)
+	if line < len(lineEnds) && offset > lineEnds[line] {
+		offset = lineEnds[line]
+	}
+	return min(offset, length)
+}
+
+// Finds the offset of every newline in the text
+func findLineEnds(runes []rune) []int {
+	var lineEnds []int
+	for i, r := range runes {
+		if r == '\n' {
+			lineEnds = append(lineEnds, i)
+		}
+	}
+	return lineEnds
+}
+
+// Converts byte offsets as returned by the regexp package into rune offsets
+func runeOffsets(text string, byteOffsets ...int) []int {
+	ret := make([]int, len(byteOffsets))
+	for i, byteOffset := range byteOffsets {
+		if byteOffset < 0 {
+			ret[i] = byteOffset
+			continue
+		}
+		ret[i] = len([]rune(text[:byteOffset]))
+	}
+	return ret
+}
@@ -0,0 +1,127 @@
+package lsportal
+
+import (
+	"testing"
+
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestSourceMapWithPrefixAndSuffix(t *testing.T) {
+	// virtual: "   WHERE id = 1;   \n WHERE x; "
+	text := "a ~id = 1~ b\n~x~"
+	sourceMap := isolateInclusions(text, Isolation{Regex: `~([\s\S]*?)~`, Prefix: "WHERE ", Suffix: ";"}).SourceMap
+
+	toVirtual := []struct {
+		name     string
+		host     protocol.Position
+		expected protocol.Position
+	}{
+		{"before inclusion", protocol.Position{Line: 0, Character: 1}, protocol.Position{Line: 0, Character: 1}},
+		{"start of inclusion lands after the prefix", protocol.Position{Line: 0, Character: 3}, protocol.Position{Line: 0, Character: 9}},
+		{"end of inclusion lands before the suffix", protocol.Position{Line: 0, Character: 9}, protocol.Position{Line: 0, Character: 15}},
+		{"after inclusion", protocol.Position{Line: 0, Character: 11}, protocol.Position{Line: 0, Character: 18}},
+		{"next line", protocol.Position{Line: 1, Character: 1}, protocol.Position{Line: 1, Character: 7}},
+	}
+	for _, tc := range toVirtual {
+		t.Run(tc.name, func(t *testing.T) {
+			virtual, ok := sourceMap.ToVirtual(tc.host)
+			if !ok || virtual != tc.expected {
+				t.Errorf("Expected: %v, Got: %v (%v)", tc.expected, virtual, ok)
+			}
+			host, ok := sourceMap.ToHost(virtual)
+			if !ok || host != tc.host {
+				t.Errorf("Expected round trip to %v, Got: %v (%v)", tc.host, host, ok)
+			}
+		})
+	}
+
+	// Positions inside injected text can't be mapped back
+	for _, pos := range []protocol.Position{{Line: 0, Character: 5}, {Line: 1, Character: 3}} {
+		if host, ok := sourceMap.ToHost(pos); ok {
+			t.Errorf("Expected %v to be unmappable, Got: %v", pos, host)
+		}
+	}
+
+	ranges := []struct {
+		name     string
+		virtual  protocol.Range
+		expected *protocol.Range
+	}{
+		{"within the inclusion", protocol.Range{Start: protocol.Position{Line: 0, Character: 10}, End: protocol.Position{Line: 0, Character: 12}}, &protocol.Range{Start: protocol.Position{Line: 0, Character: 4}, End: protocol.Position{Line: 0, Character: 6}}},
+		{"up to the prefix", protocol.Range{Start: protocol.Position{Line: 0, Character: 0}, End: protocol.Position{Line: 0, Character: 3}}, &protocol.Range{Start: protocol.Position{Line: 0, Character: 0}, End: protocol.Position{Line: 0, Character: 3}}},
+		{"covering the prefix", protocol.Range{Start: protocol.Position{Line: 0, Character: 3}, End: protocol.Position{Line: 0, Character: 10}}, nil},
+		{"running into the suffix", protocol.Range{Start: protocol.Position{Line: 0, Character: 12}, End: protocol.Position{Line: 0, Character: 16}}, nil},
+	}
+	for _, tc := range ranges {
+		t.Run(tc.name, func(t *testing.T) {
+			host, ok := sourceMap.RangeToHost(tc.virtual)
+			if tc.expected == nil && ok {
+				t.Errorf("Expected %v to be unmappable, Got: %v", tc.virtual, host)
+			}
+			if tc.expected != nil && (!ok || host != *tc.expected) {
+				t.Errorf("Expected: %v, Got: %v (%v)", *tc.expected, host, ok)
+			}
+		})
+	}
+}
+
+func TestSourceMapIdentity(t *testing.T) {
+	var sourceMap SourceMap
+	pos := protocol.Position{Line: 3, Character: 4}
+	if moved, ok := sourceMap.ToVirtual(pos); !ok || moved != pos {
+		t.Errorf("Expected the zero SourceMap to be the identity, Got: %v", moved)
+	}
+}
+
+func TestSourceMapWithPlaceholder(t *testing.T) {
+	// virtual: `   <a b="__X">  `
+	text := `h(~<a b="{{.C}}">~)`
+	sourceMap := isolateInclusions(text, Isolation{Regex: `~([\s\S]*?)~`, ExclusionRegex: `{{[\s\S]*?}}`, Placeholder: "__X"}).SourceMap
+
+	// The edges of the placeholder map to the edges of the exclusion
+	if host, ok := sourceMap.ToHost(protocol.Position{Line: 0, Character: 12}); !ok || host.Character != 15 {
+		t.Errorf("Expected the end of the placeholder to map to 15, Got: %v (%v)", host, ok)
+	}
+	// But nothing inside it does
+	if host, ok := sourceMap.ToHost(protocol.Position{Line: 0, Character: 10}); ok {
+		t.Errorf("Expected the inside of the placeholder to be unmappable, Got: %v", host)
+	}
+	if virtual, ok := sourceMap.ToVirtual(protocol.Position{Line: 0, Character: 11}); ok {
+		t.Errorf("Expected the inside of the exclusion to be unmappable, Got: %v", virtual)
+	}
+
+	edit := func(start, end uint32) protocol.Range {
+		return protocol.Range{Start: protocol.Position{Line: 0, Character: start}, End: protocol.Position{Line: 0, Character: end}}
+	}
+	if !sourceMap.EditableInVirtual(edit(4, 5)) {
+		t.Errorf("Expected an edit outside the placeholder to be allowed")
+	}
+	if sourceMap.EditableInVirtual(edit(8, 14)) {
+		t.Errorf("Expected an edit covering the placeholder to be dropped")
+	}
+}
+
+func TestGetOffset(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		pos      protocol.Position
+		expected int
+	}{
+		{"within a line", "ab\ncd", protocol.Position{Line: 1, Character: 1}, 4},
+		{"past the end of a line", "ab\ncd", protocol.Position{Line: 0, Character: 9}, 2},
+		{"one line", "abc", protocol.Position{Line: 0, Character: 2}, 2},
+		{"one line, past the last line", "abc", protocol.Position{Line: 2, Character: 1}, 3},
+		{"past the end of the last line", "ab\ncd", protocol.Position{Line: 1, Character: 50}, 5},
+		{"past the last line", "ab\ncd", protocol.Position{Line: 7, Character: 3}, 5},
+		{"empty text", "", protocol.Position{Line: 1, Character: 1}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runes := []rune(test.text)
+			if got := getOffset(test.pos, findLineEnds(runes), len(runes)); got != test.expected {
+				t.Errorf("Expected: %d, Got: %d", test.expected, got)
+			}
+		})
+	}
+}
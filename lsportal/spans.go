@@ -0,0 +1,301 @@
+package lsportal
+
+// OpenTelemetry spans for the forwarding pipeline, exported as OTLP/JSON to a file or a collector.
+// Every message a forwarder handles gets a span, with children for transforming it, forwarding it and transforming the
+// response. Transform steps add their own children through the span in the glsp context, so a slow completion shows
+// whether isolating, re-marshalling or the inner server took the time.
+// Spans carry the same lsportal.id as the --trace entries, which is the JSON-RPC id of forwarded requests.
+
+import (
+	"bytes"
+	contextpkg "context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// Exports every span once it ends, a nil exporter records nothing
+type SpanExporter struct {
+	export func(batch []byte) error
+	closer io.Closer
+	spans  chan otlpSpan
+	done   chan struct{}
+	// Guards spans against ending after Close
+	lock   sync.RWMutex
+	closed bool
+	// How many spans go out at once, and how long a span waits for others before going out anyway
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// Exports to an OTLP/HTTP collector when target is an http(s) url, otherwise appends to the file at target, one
+// export request per line the way the collector's file exporter writes them
+func OpenSpanExporter(target string) (*SpanExporter, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		if !strings.Contains(strings.SplitN(target, "//", 2)[1], "/") {
+			target += "/v1/traces"
+		}
+		client := &http.Client{Timeout: 5 * time.Second}
+		return newSpanExporter(func(batch []byte) error {
+			response, err := client.Post(target, "application/json", bytes.NewReader(batch))
+			if err != nil {
+				return err
+			}
+			response.Body.Close()
+			if response.StatusCode >= 300 {
+				return fmt.Errorf("collector answered %s", response.Status)
+			}
+			return nil
+		}, nil), nil
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return NewSpanExporter(file, file), nil
+}
+
+// Writes export requests as JSONL, closer is closed with the exporter and may be nil
+func NewSpanExporter(writer io.Writer, closer io.Closer) *SpanExporter {
+	return newSpanExporter(func(batch []byte) error {
+		_, err := writer.Write(append(batch, '\n'))
+		return err
+	}, closer)
+}
+
+func newSpanExporter(export func(batch []byte) error, closer io.Closer) *SpanExporter {
+	self := &SpanExporter{
+		export:        export,
+		closer:        closer,
+		spans:         make(chan otlpSpan, 4096),
+		done:          make(chan struct{}),
+		BatchSize:     256,
+		FlushInterval: time.Second,
+	}
+	go self.run()
+	return self
+}
+
+// Exports the spans that ended so far and stops
+func (self *SpanExporter) Close() error {
+	if self == nil {
+		return nil
+	}
+	self.lock.Lock()
+	if !self.closed {
+		self.closed = true
+		close(self.spans)
+	}
+	self.lock.Unlock()
+	<-self.done
+	if self.closer != nil {
+		return self.closer.Close()
+	}
+	return nil
+}
+
+func (self *SpanExporter) run() {
+	defer close(self.done)
+	ticker := time.NewTicker(self.FlushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case span, ok := <-self.spans:
+			if !ok {
+				self.flush(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) < self.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		self.flush(batch)
+		batch = nil
+	}
+}
+
+func (self *SpanExporter) flush(batch []otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	request := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]any{"service.name": "lsportal"})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "lsportal"}, Spans: batch}},
+	}}}
+	bytes, err := json.Marshal(request)
+	if err == nil {
+		err = self.export(bytes)
+	}
+	if err != nil {
+		// Telemetry shouldn't break the editor
+		fmt.Fprintf(os.Stderr, "error exporting spans: %v\n", err)
+	}
+}
+
+// A span that hasn't ended yet, a nil span records nothing
+type span struct {
+	exporter *SpanExporter
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	lock     sync.Mutex
+	attrs    map[string]any
+}
+
+type spanKey struct{}
+
+// Starts a span that isn't part of any other, returning a context carrying it for the children
+func (self *SpanExporter) startRoot(ctx contextpkg.Context, name string, kind int) (contextpkg.Context, *span) {
+	if self == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = contextpkg.Background()
+	}
+	span := &span{exporter: self, traceID: randomHex(16), spanID: randomHex(8), name: name, kind: kind, start: time.Now(), attrs: map[string]any{}}
+	return contextpkg.WithValue(ctx, spanKey{}, span), span
+}
+
+// Starts a child of the span in ctx, there is no span if ctx doesn't carry one
+func startSpan(ctx contextpkg.Context, name string, kind int) (contextpkg.Context, *span) {
+	if ctx == nil {
+		return ctx, nil
+	}
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &span{exporter: parent.exporter, traceID: parent.traceID, spanID: randomHex(8), parentID: parent.spanID, name: name, kind: kind, start: time.Now(), attrs: map[string]any{}}
+	return contextpkg.WithValue(ctx, spanKey{}, span), span
+}
+
+func (self *span) set(key string, value any) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.attrs[key] = value
+}
+
+// Ends the span, marking it failed if there was an error
+func (self *span) end(err error) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	otlp := otlpSpan{
+		TraceID:      self.traceID,
+		SpanID:       self.spanID,
+		ParentSpanID: self.parentID,
+		Name:         self.name,
+		Kind:         self.kind,
+		Start:        strconv.FormatInt(self.start.UnixNano(), 10),
+		End:          strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:   otlpAttributes(self.attrs),
+	}
+	self.lock.Unlock()
+	if err != nil {
+		otlp.Status = &otlpStatus{Code: 2, Message: err.Error()}
+	}
+	self.exporter.lock.RLock()
+	defer self.exporter.lock.RUnlock()
+	if self.exporter.closed {
+		return
+	}
+	select {
+	case self.exporter.spans <- otlp:
+	default:
+		// Dropping spans beats holding up messages
+	}
+}
+
+func randomHex(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// The OTLP/JSON encoding of ExportTraceServiceRequest, ids are hex and times are nanoseconds as strings
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+// Sorted by key so exports are stable
+func otlpAttributes(attrs map[string]any) []otlpAttribute {
+	var attributes []otlpAttribute
+	for _, key := range sortedKeys(attrs) {
+		var value map[string]any
+		switch typed := attrs[key].(type) {
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(typed)}
+		case bool:
+			value = map[string]any{"boolValue": typed}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(typed)}
+		}
+		attributes = append(attributes, otlpAttribute{Key: key, Value: value})
+	}
+	return attributes
+}
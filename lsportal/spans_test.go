@@ -0,0 +1,104 @@
+package lsportal
+
+import (
+	"bytes"
+	contextpkg "context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestSpans(t *testing.T) {
+	fromClient, inclusion, server := serveRoute(t, Route{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"})
+	var out bytes.Buffer
+	exporter := NewSpanExporter(&out, nil)
+	inclusion.ExportSpans(exporter)
+	server.OnHover(func(params protocol.HoverParams) *protocol.Hover {
+		return &protocol.Hover{Contents: "p"}
+	})
+
+	fromClient.Handler.Handle(&glsp.Context{
+		Method:       protocol.MethodTextDocumentDidOpen,
+		Params:       []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x ~<p>~"}}`),
+		Notification: true,
+		Context:      contextpkg.Background(),
+	})
+	client := connectClient(t, fromClient)
+	if _, err := client.Hover("file:///a.go", 0, 4); err != nil {
+		t.Fatalf("Failed to hover: %v", err)
+	}
+	client.Close()
+	exporter.Close()
+
+	var spans []otlpSpan
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var request otlpRequest
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			t.Fatalf("Expected OTLP/JSON, Got: %q", line)
+		}
+		spans = append(spans, request.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}
+	// The spans in the trace of the message, by name
+	traceOf := func(method string) map[string]otlpSpan {
+		byName := map[string]otlpSpan{}
+		for _, root := range spans {
+			if root.Name != method {
+				continue
+			}
+			for _, span := range spans {
+				if span.TraceID == root.TraceID {
+					byName[span.Name] = span
+				}
+			}
+		}
+		return byName
+	}
+	attribute := func(span otlpSpan, key string) any {
+		for _, attribute := range span.Attributes {
+			if attribute.Key == key {
+				return attribute.Value["stringValue"]
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		method string
+		name   string
+		parent string
+		kind   int
+	}{
+		{method: protocol.MethodTextDocumentHover, name: protocol.MethodTextDocumentHover, kind: spanServer},
+		{method: protocol.MethodTextDocumentHover, name: "transform request", parent: protocol.MethodTextDocumentHover, kind: spanInternal},
+		{method: protocol.MethodTextDocumentHover, name: "runParamsTransform", parent: "transform request", kind: spanInternal},
+		{method: protocol.MethodTextDocumentHover, name: "marshal params", parent: "runParamsTransform", kind: spanInternal},
+		{method: protocol.MethodTextDocumentHover, name: "forward textDocument/hover", parent: protocol.MethodTextDocumentHover, kind: spanClient},
+		{method: protocol.MethodTextDocumentHover, name: "transform response", parent: protocol.MethodTextDocumentHover, kind: spanInternal},
+		{method: protocol.MethodTextDocumentDidOpen, name: "isolate", parent: "runParamsTransform", kind: spanInternal},
+	}
+	for _, test := range tests {
+		byName := traceOf(test.method)
+		span, ok := byName[test.name]
+		if !ok {
+			t.Errorf("Expected a %q span, Got: %v", test.name, spans)
+			continue
+		}
+		if span.Kind != test.kind {
+			t.Errorf("Expected %q to be of kind %d, Got: %d", test.name, test.kind, span.Kind)
+		}
+		if test.parent != "" && span.ParentSpanID != byName[test.parent].SpanID {
+			t.Errorf("Expected %q to be a child of %q", test.name, test.parent)
+		}
+	}
+	byName := traceOf(protocol.MethodTextDocumentHover)
+	hover, forward := byName[protocol.MethodTextDocumentHover], byName["forward textDocument/hover"]
+	if forward.TraceID != hover.TraceID || attribute(forward, "rpc.jsonrpc.request_id") != "lsportal-"+attribute(hover, "lsportal.id").(string) {
+		t.Errorf("Expected the forwarded call in the same trace with the JSON-RPC id it was sent with, Got: %v and %v", hover, forward)
+	}
+	if id, _ := attribute(hover, "rpc.jsonrpc.request_id").(string); id == "" || strings.HasPrefix(id, "lsportal-") {
+		t.Errorf("Expected the handled request with the JSON-RPC id the client sent, Got: %v", hover)
+	}
+}
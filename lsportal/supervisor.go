@@ -0,0 +1,454 @@
+package lsportal
+
+// The supervisor keeps an inclusion server running.
+// When the process exits we restart it with backoff and replay initialize and the open documents,
+// so the client never has to know the server went away.
+
+import (
+	contextpkg "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/tliron/commonlog"
+	. "github.com/tliron/glsp/protocol_3_16"
+	"github.com/tliron/glsp/server"
+)
+
+type Supervisor struct {
+	logger  commonlog.Logger
+	Command string
+	Args    []string
+	// Connect to a server that is already running instead of spawning Command
+	Transport Transport
+	inclusion *Inclusion
+	client    *server.Server
+	// How many times in a row we restart a server that keeps crashing before giving up
+	MaxRestarts int
+	// The delay before the first restart, doubling with each crash up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// A server that stays up this long is considered healthy again and resets the backoff
+	StableAfter time.Duration
+	// A server that exits sooner than this failed to start, and we tell the user why
+	StartupPeriod time.Duration
+	// Forward everything the server writes to stderr to the client as window/logMessage
+	ForwardStderr bool
+	// Where to run the server, the workspace root the client initializes with if empty
+	Dir string
+	// KEY=VALUE pairs added to the server's environment
+	Env []string
+	// Directories put in front of the server's PATH, see [ProcessOptions]
+	PathPrepend []string
+	// Only start the server once a document with an inclusion is open
+	Lazy bool
+	// Stop a lazy server after this long without any inclusions open, never if zero
+	IdleTimeout time.Duration
+
+	lock    sync.Mutex
+	stopped bool
+	// Closed by Stop
+	stopping chan struct{}
+	// The process being served right now
+	current io.ReadWriteCloser
+	// Closed when Run returns
+	done chan struct{}
+	// Where a lazy server is at, see lazyStart.go
+	lazyState lazyState
+	ready     chan struct{}
+	wake      chan struct{}
+	idled     bool
+	// The lazily started server's capabilities were registered with the client
+	registered bool
+	// The connection to the server while it is being served, closing connected lets the messages waiting for it through
+	connection *jsonrpc2.Conn
+	connected  chan struct{}
+	// Notifications the client sent before the server was first connected, eg: while it waits for the workspace root
+	started bool
+	held    []heldNotification
+}
+
+type heldNotification struct {
+	method string
+	params json.RawMessage
+}
+
+// How long the server gets to answer initialize, it may have only just been started for it
+const initializeTimeout = 30 * time.Second
+
+// Creates a supervisor for the inclusion server, call Run to start it.
+// client can be nil when the inclusion server is shared, its messages then go to every client
+func NewSupervisor(client *server.Server, inclusion *Inclusion, command string, args []string) *Supervisor {
+	supervisor := &Supervisor{
+		logger:        commonlog.GetLoggerf("supervisor.%s", inclusion.Server.LogBaseName),
+		Command:       command,
+		Args:          args,
+		inclusion:     inclusion,
+		client:        client,
+		MaxRestarts:   5,
+		Backoff:       500 * time.Millisecond,
+		MaxBackoff:    30 * time.Second,
+		StableAfter:   time.Minute,
+		StartupPeriod: 5 * time.Second,
+		stopping:      make(chan struct{}),
+		done:          make(chan struct{}),
+		ready:         make(chan struct{}),
+		connected:     make(chan struct{}),
+		wake:          make(chan struct{}, 1),
+	}
+	inclusion.supervisor = supervisor
+	return supervisor
+}
+
+// Starts the inclusion server and serves it, restarting it whenever it exits until Stop is called.
+// Returns an error if the server can't be started at all
+func (self *Supervisor) Run() error {
+	defer close(self.done)
+	if self.Transport.Kind == TransportStdio && self.Dir == "" {
+		// The server runs in the workspace root, which we only know once the client initializes.
+		// Notifications the client sends before that are held back for the server, see hold
+		select {
+		case <-self.inclusion.transformer.initialized:
+		case <-self.stopping:
+			return nil
+		}
+	}
+	crashes := 0
+	restarting := false
+	crashed := false
+	for {
+		if self.Lazy && !self.waitForInclusions() {
+			return nil
+		}
+		readWrite, err := self.open()
+		if err != nil {
+			if !restarting && !self.Lazy {
+				return fmt.Errorf("error starting language server: %v", err)
+			}
+			self.logger.Errorf("error starting language server: %v", err)
+			if self.Lazy {
+				self.markExited()
+			}
+		} else {
+			self.setCurrent(readWrite)
+			connection := connect(self.inclusion.Server, readWrite)
+			replayed := make(chan struct{})
+			if restarting || self.Lazy {
+				// A lazy server never saw the client's initialize, so it always needs the replay.
+				// The client's messages wait for it, so the server sees them after its initialize and documents
+				go func(announce bool) {
+					defer close(replayed)
+					initializeResult, ok := self.replay(connection, announce)
+					self.setConnection(connection)
+					self.markReady()
+					if self.Lazy && ok {
+						self.registerCapabilities(initializeResult)
+					}
+				}(crashed)
+			} else {
+				close(replayed)
+				self.setConnection(connection)
+			}
+			exited := make(chan struct{})
+			if self.Lazy && self.IdleTimeout > 0 {
+				go self.watchIdle(readWrite, exited)
+			}
+			started := time.Now()
+			<-connection.DisconnectNotify()
+			// The replay gives up on the closed connection, it mustn't let the messages through after we hold them back
+			<-replayed
+			self.setConnection(nil)
+			exitErr := readWrite.Close()
+			close(exited)
+			self.setCurrent(nil)
+			if self.isStopped() {
+				return nil
+			}
+			if self.Lazy {
+				self.markExited()
+			}
+			if self.takeIdled() {
+				crashed = false
+				continue
+			}
+			ran := time.Since(started)
+			if ran > self.StableAfter {
+				crashes = 0
+			}
+			if ran < self.StartupPeriod {
+				self.logger.Errorf("%s exited during startup: %v", self.Command, exitErr)
+				self.showMessage(MessageTypeError, fmt.Sprintf("%s exited during startup: %v", self.Command, exitErr))
+			} else if exitErr != nil {
+				self.logger.Errorf("%s exited: %v", self.Command, exitErr)
+			}
+		}
+		if self.isStopped() {
+			return nil
+		}
+
+		crashes++
+		if crashes > self.MaxRestarts {
+			self.showMessage(MessageTypeError, fmt.Sprintf("%s keeps exiting, giving up after %d restarts", self.Command, self.MaxRestarts))
+			return fmt.Errorf("%s exited %d times in a row", self.Command, crashes)
+		}
+		delay := self.backoff(crashes)
+		self.logger.Warningf("%s exited, restarting in %s", self.Command, delay)
+		self.showMessage(MessageTypeWarning, fmt.Sprintf("%s exited, restarting it", self.Command))
+		time.Sleep(delay)
+		self.inclusion.fromClient.metrics.restarted(self.inclusion.Route.Name)
+		restarting = true
+		crashed = true
+	}
+}
+
+// Stops restarting the server, call this before shutting it down on purpose
+func (self *Supervisor) Stop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.stopped {
+		close(self.stopping)
+	}
+	self.stopped = true
+}
+
+func (self *Supervisor) isStopped() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stopped
+}
+
+func (self *Supervisor) setCurrent(readWrite io.ReadWriteCloser) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.current = readWrite
+}
+
+// Lets the messages waiting for the server through, or holds them back again while it is gone if connection is nil
+func (self *Supervisor) setConnection(connection *jsonrpc2.Conn) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if connection != nil && self.connection == nil {
+		close(self.connected)
+		self.started = true
+	} else if connection == nil && self.connection != nil {
+		self.connected = make(chan struct{})
+	}
+	self.connection = connection
+}
+
+// Holds the notification back if the server was never connected yet, returns true if it did.
+// Waiting for the server instead would time the notification out, the server may only start once the client initializes
+func (self *Supervisor) hold(method string, params json.RawMessage) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.started {
+		return false
+	}
+	self.held = append(self.held, heldNotification{method, params})
+	return true
+}
+
+// Sends the notifications that were held back, call before forwarding anything but initialize
+func (self *Supervisor) sendHeld(ctx contextpkg.Context, connection *jsonrpc2.Conn) error {
+	self.lock.Lock()
+	held := self.held
+	self.held = nil
+	self.lock.Unlock()
+	for _, notification := range held {
+		if err := connection.Notify(ctx, notification.method, notification.params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Waits for the server to be served, it may not be started or be restarting
+func (self *Supervisor) awaitConnection(ctx contextpkg.Context) (*jsonrpc2.Conn, error) {
+	for {
+		self.lock.Lock()
+		connection, connected := self.connection, self.connected
+		self.lock.Unlock()
+		if connection != nil {
+			return connection, nil
+		}
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s isn't running", self.Command)
+		}
+	}
+}
+
+// Stops the server and kills the process it is running, if any
+func (self *Supervisor) kill() {
+	self.Stop()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.current == nil {
+		return
+	}
+	if err := terminate(self.current); err != nil {
+		self.logger.Errorf("error killing %s: %v", self.Command, err)
+	}
+}
+
+// Kills the process, or hangs up on servers we connected to as we don't own them
+func terminate(readWrite io.ReadWriteCloser) error {
+	if killer, ok := readWrite.(interface{ Kill() error }); ok {
+		return killer.Kill()
+	}
+	return readWrite.Close()
+}
+
+// Spawns the server or connects to it
+func (self *Supervisor) open() (io.ReadWriteCloser, error) {
+	if self.Transport.Kind == TransportStdio {
+		return StartLanguageServerWith(self.Command, self.Args, self.processOptions())
+	}
+	return Dial(self.Transport)
+}
+
+func (self *Supervisor) backoff(crashes int) time.Duration {
+	delay := self.Backoff
+	for i := 1; i < crashes && delay < self.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, self.MaxBackoff)
+}
+
+// Brings a restarted or lazily started server back to where the last one was: initialize, initialized, configuration and a didOpen
+// for every document we are tracking. Returns the result of initialize, false if there was nothing to replay or it failed
+func (self *Supervisor) replay(connection *jsonrpc2.Conn, announce bool) (any, bool) {
+	state := self.inclusion.transformer.replayState()
+	if state.initialize == nil {
+		// The client hasn't initialized yet, so it will do it itself
+		return nil, false
+	}
+
+	ctx, cancel := contextpkg.WithTimeout(contextpkg.Background(), initializeTimeout)
+	defer cancel()
+	var result any
+	if err := connection.Call(ctx, MethodInitialize, state.initialize, &result); err != nil {
+		self.logger.Errorf("error replaying initialize: %v", err)
+		return nil, false
+	}
+	if err := connection.Notify(ctx, MethodInitialized, InitializedParams{}); err != nil {
+		self.logger.Errorf("error replaying initialized: %v", err)
+		return nil, false
+	}
+	if state.configuration != nil {
+		if err := connection.Notify(ctx, MethodWorkspaceDidChangeConfiguration, state.configuration); err != nil {
+			self.logger.Errorf("error replaying configuration: %v", err)
+		}
+	}
+	for _, document := range state.documents {
+		if err := connection.Notify(ctx, MethodTextDocumentDidOpen, document); err != nil {
+			self.logger.Errorf("error replaying didOpen for %s: %v", document.TextDocument.URI, err)
+		}
+	}
+	self.logger.Infof("started %s, replayed %d documents", self.Command, len(state.documents))
+	if announce {
+		self.showMessage(MessageTypeInfo, fmt.Sprintf("%s restarted", self.Command))
+	}
+	return result, true
+}
+
+func (self *Supervisor) processOptions() ProcessOptions {
+	options := ProcessOptions{
+		Dir:         self.Dir,
+		Env:         self.Env,
+		PathPrepend: self.PathPrepend,
+	}
+	if options.Dir == "" {
+		options.Dir = self.inclusion.transformer.workspaceRoot()
+	}
+	if self.ForwardStderr {
+		options.OnStderr = func(line string) {
+			self.notifyClient(ServerWindowLogMessage, LogMessageParams{Type: MessageTypeLog, Message: line})
+		}
+	}
+	return options
+}
+
+func (self *Supervisor) showMessage(messageType MessageType, message string) {
+	self.notifyClient(ServerWindowShowMessage, ShowMessageParams{Type: messageType, Message: message})
+}
+
+func (self *Supervisor) notifyClient(method string, params any) {
+	ctx, cancel := contextpkg.WithTimeout(contextpkg.Background(), 2*time.Second)
+	defer cancel()
+	var err error
+	if self.inclusion.toClient != nil && self.inclusion.toClient.clients != nil {
+		err = self.inclusion.toClient.clients.notify(ctx, method, params)
+	} else if self.client != nil {
+		if connection := connectionOf(self.client); connection != nil {
+			err = connection.Notify(ctx, method, params)
+		}
+	}
+	if err != nil {
+		self.logger.Errorf("error sending %s: %v", method, err)
+	}
+}
+
+// The directory of the workspace the client initialized with, empty if it didn't say
+func (trans *FromClientTransformer) workspaceRoot() string {
+	trans.lock.RLock()
+	defer trans.lock.RUnlock()
+	var params struct {
+		RootPath         *string           `json:"rootPath"`
+		RootURI          *DocumentUri      `json:"rootUri"`
+		WorkspaceFolders []WorkspaceFolder `json:"workspaceFolders"`
+	}
+	if err := json.Unmarshal(trans.initializeParams, &params); err != nil {
+		return ""
+	}
+	switch {
+	case params.RootURI != nil:
+		return uriToPath(*params.RootURI)
+	case len(params.WorkspaceFolders) > 0:
+		return uriToPath(params.WorkspaceFolders[0].URI)
+	case params.RootPath != nil:
+		return *params.RootPath
+	}
+	return ""
+}
+
+func uriToPath(uri DocumentUri) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "file" {
+		return ""
+	}
+	return filepath.FromSlash(parsed.Path)
+}
+
+// What a restarted inclusion server needs to get back to where the last one was
+type replayState struct {
+	initialize    json.RawMessage
+	configuration json.RawMessage
+	documents     []DidOpenTextDocumentParams
+}
+
+func (trans *FromClientTransformer) replayState() replayState {
+	trans.lock.RLock()
+	defer trans.lock.RUnlock()
+	state := replayState{
+		initialize:    trans.initializeParams,
+		configuration: trans.configurationParams,
+	}
+	for uri, doc := range trans.Documents {
+		state.documents = append(state.documents, DidOpenTextDocumentParams{
+			TextDocument: TextDocumentItem{
+				URI:        trans.changeExtension(uri),
+				LanguageID: doc.LanguageID,
+				Version:    doc.Version,
+				Text:       isolateInclusions(doc.Text, trans.isolation()).Text,
+			},
+		})
+	}
+	return state
+}
@@ -0,0 +1,145 @@
+package lsportal
+
+import (
+	contextpkg "context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestSupervisorBackoff(t *testing.T) {
+	supervisor := Supervisor{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, delay := range expected {
+		if got := supervisor.backoff(i + 1); got != delay {
+			t.Errorf("Expected crash %d to wait %s, Got: %s", i+1, delay, got)
+		}
+	}
+}
+
+func TestReplayBeforeForwarding(t *testing.T) {
+	server := &recordingServer{initializeDelay: 100 * time.Millisecond}
+	address := server.listen(t)
+	fromClient, inclusions, _ := InitRoutes(false, []Route{{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"}})
+	supervisor := NewSupervisor(fromClient, inclusions[0], "tcp:"+address, nil)
+	supervisor.Transport = Transport{Kind: TransportTCP, Address: address}
+	supervisor.Backoff = 10 * time.Millisecond
+	go supervisor.Run()
+	defer supervisor.kill()
+
+	send := func(method string, params string) {
+		fromClient.Handler.Handle(&glsp.Context{
+			Method:       method,
+			Params:       []byte(params),
+			Notification: method == protocol.MethodTextDocumentDidOpen,
+			Context:      contextpkg.Background(),
+		})
+	}
+	send(protocol.MethodInitialize, `{"rootUri": "file:///project"}`)
+	send(protocol.MethodTextDocumentDidOpen, `{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x ~<p>~"}}`)
+	waitFor(t, "the document to be opened", func() bool {
+		_, methods := server.state()
+		return len(methods) == 2
+	})
+
+	// The server goes away, the hover has to wait for the new one to be initialized and have the document
+	supervisor.lock.Lock()
+	supervisor.current.Close()
+	supervisor.lock.Unlock()
+	waitFor(t, "the server to be gone", func() bool {
+		supervisor.lock.Lock()
+		defer supervisor.lock.Unlock()
+		return supervisor.connection == nil
+	})
+	send(protocol.MethodTextDocumentHover, `{"textDocument": {"uri": "file:///a.go"}, "position": {"line": 0, "character": 4}}`)
+	connections, methods := server.state()
+	expected := []string{protocol.MethodInitialize, protocol.MethodTextDocumentDidOpen, protocol.MethodInitialize, protocol.MethodInitialized, protocol.MethodTextDocumentDidOpen, protocol.MethodTextDocumentHover}
+	if connections != 2 || fmt.Sprint(methods) != fmt.Sprint(expected) {
+		t.Errorf("Expected: %v, Got: %d connections, %v", expected, connections, methods)
+	}
+}
+
+func TestReplayState(t *testing.T) {
+	trans := NewFromClientTransformer(`~([\s\S]*?)~`, "", "html")
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodInitialize,
+		Params: []byte(`{"rootUri": "file:///project"}`),
+	})
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 3, "text": "x ~<p>~"}}`),
+	})
+
+	state := trans.replayState()
+	if string(state.initialize) != `{"rootUri": "file:///project"}` {
+		t.Errorf("Expected initialize to be kept for replay, Got: %s", state.initialize)
+	}
+	if len(state.documents) != 1 {
+		t.Fatalf("Expected 1 document to replay, Got: %d", len(state.documents))
+	}
+	expected := protocol.TextDocumentItem{URI: "file:///a.html", LanguageID: "go", Version: 3, Text: "   <p> "}
+	if state.documents[0].TextDocument != expected {
+		t.Errorf("Expected: %v, Got: %v", expected, state.documents[0].TextDocument)
+	}
+}
+
+func TestWorkspaceRoot(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{`{"rootUri": "file:///home/me/project", "rootPath": "/elsewhere"}`, "/home/me/project"},
+		{`{"rootUri": null, "workspaceFolders": [{"uri": "file:///a%20b", "name": "a b"}]}`, "/a b"},
+		{`{"rootPath": "/old/style"}`, "/old/style"},
+		{`{"rootUri": null}`, ""},
+	}
+	for _, test := range tests {
+		trans := NewFromClientTransformer(`~([\s\S]*?)~`, "", "html")
+		trans.TransformRequest(&glsp.Context{Method: protocol.MethodInitialize, Params: []byte(test.params)})
+		if root := trans.workspaceRoot(); root != test.expected {
+			t.Errorf("%s: Expected: %q, Got: %q", test.params, test.expected, root)
+		}
+	}
+}
+
+func TestHoldNotificationsUntilStarted(t *testing.T) {
+	fromClient, inclusion, server := serveRoute(t, Route{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"})
+	// Not run, the test connects the server in its place
+	supervisor := NewSupervisor(fromClient, inclusion, "fake", nil)
+
+	send := func(method string, params string) {
+		fromClient.Handler.Handle(&glsp.Context{
+			Method:       method,
+			Params:       []byte(params),
+			Notification: method != protocol.MethodInitialize,
+			Context:      contextpkg.Background(),
+		})
+	}
+	sent := time.Now()
+	send(protocol.MethodWorkspaceDidChangeConfiguration, `{"settings": {}}`)
+	if waited := time.Since(sent); waited > time.Second {
+		t.Errorf("Expected the notification to be held instead of waiting for the server, waited %s", waited)
+	}
+
+	connection, err := waitForConnection(contextpkg.Background(), inclusion.Server)
+	if err != nil {
+		t.Fatalf("Failed to connect the server: %v", err)
+	}
+	supervisor.setConnection(connection)
+	send(protocol.MethodInitialize, `{"rootUri": "file:///project"}`)
+	send(protocol.MethodInitialized, `{}`)
+	if _, err := server.WaitFor(protocol.MethodInitialized); err != nil {
+		t.Fatalf("Expected initialized to be forwarded: %v", err)
+	}
+	var methods []string
+	for _, message := range server.Received() {
+		methods = append(methods, message.Method)
+	}
+	expected := []string{protocol.MethodInitialize, protocol.MethodWorkspaceDidChangeConfiguration, protocol.MethodInitialized}
+	if fmt.Sprint(methods) != fmt.Sprint(expected) {
+		t.Errorf("Expected the held notification after initialize: %v, Got: %v", expected, methods)
+	}
+}
@@ -11,21 +11,41 @@ import (
 type TextDocument struct {
 	Text       string
 	URI        URI
+	LanguageID string
+	Version    Integer
 	Inclusions []Range
+	// Maps positions between this document and the virtual document the inclusion server sees
+	SourceMap SourceMap
 }
 
-func (textDocument TextDocument) UpdateAndGetChanges(params DidChangeTextDocumentParams, regex string, exclusionRegex string) (TextDocument, DidChangeTextDocumentParams, error) {
+// Which inclusion the range lies in, -1 if none
+func (textDocument *TextDocument) inclusionOf(r Range) int {
+	for i, inclusion := range textDocument.Inclusions {
+		if isInRange(inclusion, r.Start) && isInRange(inclusion, r.End) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Isolates the inclusions of the document, returning the text of the virtual document
+func (textDocument *TextDocument) Isolate(isolation Isolation) string {
+	isolated := isolateInclusions(textDocument.Text, isolation)
+	textDocument.Inclusions = isolated.Inclusions
+	textDocument.SourceMap = isolated.SourceMap
+	return isolated.Text
+}
+
+func (textDocument TextDocument) UpdateAndGetChanges(params DidChangeTextDocumentParams, isolation Isolation) (TextDocument, DidChangeTextDocumentParams, error) {
 	newDoc, err := textDocument.applychanges(&params)
 	if err != nil {
 		return textDocument, params, err
 	}
-	isolatedText, inclusions := whitespaceExceptInclusions(newDoc.Text, regex, exclusionRegex)
 	//replace any content not in inclusions with whitespace
 	inclusionDoc := TextDocument{
 		URI:  textDocument.URI,
-		Text: isolatedText,
+		Text: newDoc.Isolate(isolation),
 	}
-	newDoc.Inclusions = inclusions
 	//update the content changes to reflect the whitespaced textDocument
 	params.ContentChanges = inclusionDoc.NewChangeEventText(&params)
 
@@ -0,0 +1,157 @@
+package lsportal
+
+// The tracer writes every message the forwarders handle to a JSONL file, once for every hop it makes, so you can see
+// what the transformers did to it and how long each side took
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Hop string
+
+const (
+	HopClientToPortal Hop = "client->lsportal"
+	HopPortalToInner  Hop = "lsportal->inner"
+	HopInnerToPortal  Hop = "inner->lsportal"
+	HopPortalToClient Hop = "lsportal->client"
+)
+
+// The hops a message takes through a forwarder, depending on which side sent it
+type traceHops struct {
+	in, out, responseIn, responseOut Hop
+}
+
+// The side that sent the messages, for metrics
+func (hops traceHops) from() string {
+	if hops.in == HopClientToPortal {
+		return "client"
+	}
+	return "inclusion"
+}
+
+var (
+	clientHops    = traceHops{HopClientToPortal, HopPortalToInner, HopInnerToPortal, HopPortalToClient}
+	inclusionHops = traceHops{HopInnerToPortal, HopPortalToClient, HopClientToPortal, HopPortalToInner}
+)
+
+// One line of the trace
+type TraceEntry struct {
+	Time time.Time `json:"time"`
+	Hop  Hop       `json:"hop"`
+	// Ties the hops of a message and its response together, forwarded requests are sent with it as their JSON-RPC id
+	ID string `json:"id"`
+	// The JSON-RPC id the request came in with, on the hops between lsportal and whoever sent it
+	RequestID string `json:"requestId,omitempty"`
+	// request, notification, response or error
+	Kind   string `json:"kind"`
+	Method string `json:"method"`
+	// The route of the inclusion server, empty for the default one
+	Route   string          `json:"route,omitempty"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	// For responses, how long since the request made the matching hop
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+}
+
+// Writes trace entries as JSONL, a nil tracer traces nothing
+type Tracer struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+// Ties the trace entries and spans of a message together
+var messageIDs atomic.Int64
+
+func nextMessageID() string {
+	return strconv.FormatInt(messageIDs.Add(1), 10)
+}
+
+// Creates or truncates the trace file
+func OpenTrace(path string) (*Tracer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	tracer := NewTracer(file)
+	tracer.closer = file
+	return tracer, nil
+}
+
+func NewTracer(writer io.Writer) *Tracer {
+	encoder := json.NewEncoder(writer)
+	// Keep -> and markup readable
+	encoder.SetEscapeHTML(false)
+	return &Tracer{encoder: encoder}
+}
+
+func (self *Tracer) Close() error {
+	if self == nil || self.closer == nil {
+		return nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closer.Close()
+}
+
+func (self *Tracer) record(entry TraceEntry) {
+	if self == nil {
+		return
+	}
+	entry.Time = time.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	// A broken trace shouldn't break the editor
+	self.encoder.Encode(entry)
+}
+
+// Traces the message as it makes a hop, message is anything that marshals to JSON
+func (self *Tracer) message(hop Hop, id string, requestID string, kind string, method string, route string, message any) {
+	if self == nil {
+		return
+	}
+	self.record(TraceEntry{Hop: hop, ID: id, RequestID: requestID, Kind: kind, Method: method, Route: route, Message: traceJson(message)})
+}
+
+// Traces the response or error of a request, since is when the request made the matching hop
+func (self *Tracer) response(hop Hop, id string, requestID string, method string, route string, result any, err error, since time.Time) {
+	if self == nil {
+		return
+	}
+	entry := TraceEntry{
+		Hop:       hop,
+		ID:        id,
+		RequestID: requestID,
+		Kind:      "response",
+		Method:    method,
+		Route:     route,
+		LatencyMs: float64(time.Since(since).Microseconds()) / 1000,
+	}
+	if err != nil {
+		entry.Kind = "error"
+		entry.Error = err.Error()
+	} else {
+		entry.Message = traceJson(result)
+	}
+	self.record(entry)
+}
+
+func traceJson(message any) json.RawMessage {
+	switch value := message.(type) {
+	case nil:
+		return nil
+	case json.RawMessage:
+		return value
+	}
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		return nil
+	}
+	return bytes
+}
@@ -0,0 +1,97 @@
+package lsportal
+
+import (
+	"bytes"
+	contextpkg "context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestTraceHops(t *testing.T) {
+	server := &recordingServer{}
+	address := server.listen(t)
+	fromClient, inclusions, _ := InitRoutes(false, []Route{{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"}})
+	var trace bytes.Buffer
+	inclusions[0].Trace(NewTracer(&trace))
+	supervisor := NewSupervisor(fromClient, inclusions[0], "tcp:"+address, nil)
+	supervisor.Transport = Transport{Kind: TransportTCP, Address: address}
+	go supervisor.Run()
+	defer supervisor.kill()
+
+	fromClient.Handler.Handle(&glsp.Context{
+		Method:       protocol.MethodTextDocumentDidOpen,
+		Params:       []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 1, "text": "x ~<p>~"}}`),
+		Notification: true,
+		Context:      contextpkg.Background(),
+	})
+	// The hover comes over a connection, so it has a JSON-RPC id of its own
+	client := connectClient(t, fromClient)
+	var hover any
+	if err := client.Call(protocol.MethodTextDocumentHover, json.RawMessage(`{"textDocument": {"uri": "file:///a.go"}, "position": {"line": 0, "character": 4}}`), &hover); err != nil {
+		t.Fatalf("Failed to hover: %v", err)
+	}
+
+	var hovers []TraceEntry
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		var entry TraceEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected JSONL, Got: %q", line)
+		}
+		if entry.Method == protocol.MethodTextDocumentHover {
+			hovers = append(hovers, entry)
+		}
+	}
+	expected := []Hop{HopClientToPortal, HopPortalToInner, HopInnerToPortal, HopPortalToClient}
+	if len(hovers) != len(expected) {
+		t.Fatalf("Expected the hover at %d hops, Got: %v", len(expected), hovers)
+	}
+	for i, hop := range expected {
+		if hovers[i].Hop != hop || hovers[i].ID != hovers[0].ID {
+			t.Errorf("Expected hop %d to be %s of message %s, Got: %s of %s", i, hop, hovers[0].ID, hovers[i].Hop, hovers[i].ID)
+		}
+	}
+	if hovers[0].RequestID == "" || hovers[3].RequestID != hovers[0].RequestID || hovers[1].RequestID != "" || hovers[2].RequestID != "" {
+		t.Errorf("Expected the client's JSON-RPC id on the hops to and from the client only, Got: %v", hovers)
+	}
+	if !strings.Contains(string(hovers[0].Message), "a.go") || !strings.Contains(string(hovers[1].Message), "a.html") {
+		t.Errorf("Expected the trace to show the uri before and after transforming, Got: %s and %s", hovers[0].Message, hovers[1].Message)
+	}
+	if hovers[2].Kind != "response" || hovers[3].LatencyMs < hovers[2].LatencyMs {
+		t.Errorf("Expected responses with the total latency covering the inner one, Got: %v and %v", hovers[2], hovers[3])
+	}
+}
+
+func TestTraceStandby(t *testing.T) {
+	fromClient, inclusions, _ := InitRoutes(false, []Route{{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"}})
+	var trace bytes.Buffer
+	inclusions[0].Trace(NewTracer(&trace))
+	metrics := NewMetrics()
+	inclusions[0].Measure(metrics)
+	// Never run, so the lazy server stays on standby
+	supervisor := NewSupervisor(fromClient, inclusions[0], "tcp:127.0.0.1:0", nil)
+	supervisor.Lazy = true
+
+	fromClient.Handler.Handle(&glsp.Context{
+		Method:  protocol.MethodInitialize,
+		Params:  []byte(`{"rootUri": "file:///project", "capabilities": {}}`),
+		Context: contextpkg.Background(),
+	})
+	answered := false
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		var entry TraceEntry
+		json.Unmarshal([]byte(line), &entry)
+		answered = answered || (entry.Hop == HopPortalToClient && entry.Method == protocol.MethodInitialize)
+	}
+	if !answered {
+		t.Errorf("Expected the answer the standby gave to be traced, Got:\n%s", trace.String())
+	}
+	var out strings.Builder
+	metrics.WriteTo(&out)
+	if expected := `lsportal_transform_seconds_count{from="client",method="initialize",route=""} 1`; !strings.Contains(out.String(), expected+"\n") {
+		t.Errorf("Expected the metrics to contain %q, Got:\n%s", expected, out.String())
+	}
+}
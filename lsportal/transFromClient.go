@@ -2,8 +2,11 @@ package lsportal
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tliron/commonlog"
 	"github.com/tliron/glsp"
@@ -12,19 +15,44 @@ import (
 
 type Transformer interface {
 	TransformRequest(context *glsp.Context) error
-	TransformResponse(response *any)
+	// Transforms the response to a request, the context holds the request as it was forwarded.
+	// An error goes back to the sender instead of the response
+	TransformResponse(context *glsp.Context, response *any) error
 }
 
 // Proves that ServerTransformer implements Transformer
 var _ Transformer = &FromClientTransformer{}
 
 type FromClientTransformer struct {
-	logger         commonlog.Logger
+	logger commonlog.Logger
+	// Guards the documents, which are read from the inclusion server side while the client updates them
+	lock           sync.RWMutex
 	Regex          string
 	ExclusionRegex string
-	Extension      string
+	// Text to wrap around every inclusion in the virtual document, see [Isolation]
+	Prefix string
+	Suffix string
+	// Token that stands in for exclusions, see [Isolation]
+	Placeholder           string
+	PlaceholderSameLength bool
+	// Named groups of the regex this transformer takes or leaves for others, see [Isolation]
+	Groups     []string
+	SkipGroups []string
+	Extension  string
+	// Nest document symbols under a symbol for each inclusion
+	GroupSymbols bool
+	// Add a folding range for each inclusion spanning several lines
+	FoldInclusions bool
 	UriMap         map[string]string
 	Documents      map[string]TextDocument
+	// The last initialize and configuration the client sent, so a restarted inclusion server can be brought back up
+	initializeParams    json.RawMessage
+	configurationParams json.RawMessage
+	// Closed once the client sent initialize
+	initialized    chan struct{}
+	semanticTokens semanticTokensState
+	metrics        *Metrics
+	route          string
 }
 
 // New
@@ -35,25 +63,43 @@ func NewFromClientTransformer(regex string, exclusionRegex string, extension str
 		Extension:      extension,
 		UriMap:         make(map[string]string),
 		Documents:      make(map[string]TextDocument),
+		initialized:    make(chan struct{}),
 		logger:         commonlog.GetLogger("FromClientTransformer")}
 }
 
 // Transform requests from the client so that the inclusion server is happy
 func (trans *FromClientTransformer) TransformRequest(context *glsp.Context) error {
+	trans.lock.Lock()
+	defer trans.lock.Unlock()
 	switch context.Method {
+	case MethodInitialize:
+		if trans.initializeParams == nil && trans.initialized != nil {
+			close(trans.initialized)
+		}
+		trans.initializeParams = context.Params
+		trans.semanticTokens.rememberClientLegend(context.Params)
+	case MethodWorkspaceDidChangeConfiguration:
+		trans.configurationParams = context.Params
 	case MethodTextDocumentDidChange:
 		runParamsTransform(context, func(params *DidChangeTextDocumentParams) error {
 			originalUri := params.TextDocument.URI
 			params.TextDocument.URI = trans.changeExtension(params.TextDocument.URI)
 
-			newDoc, newParams, err := trans.Documents[originalUri].UpdateAndGetChanges(*params, trans.Regex, trans.ExclusionRegex)
+			start := time.Now()
+			_, span := startSpan(context.Context, "isolate", spanInternal)
+			newDoc, newParams, err := trans.Documents[originalUri].UpdateAndGetChanges(*params, trans.isolation())
+			span.set("lsportal.inclusions", len(newDoc.Inclusions))
+			span.end(err)
+			trans.metrics.isolated(trans.route, time.Since(start))
 			trans.logger.Debugf("Updated document: %s", newDoc)
 			//TODO: figure out error handling
 			if err != nil {
 				return fmt.Errorf("Error applying changes to document: %v", err)
 			}
 			//Newdoc has the changes applied but doesn't have the inclusions isolated
+			newDoc.Version = params.TextDocument.Version
 			trans.Documents[originalUri] = newDoc
+			trans.metrics.documentInclusions(trans.route, originalUri, len(newDoc.Inclusions))
 			params.ContentChanges = newParams.ContentChanges
 			return nil
 
@@ -65,49 +111,116 @@ func (trans *FromClientTransformer) TransformRequest(context *glsp.Context) erro
 			params.TextDocument.URI = trans.changeExtension(originalUri)
 			//We need to save this so we can change the URI back to the original in the response
 			trans.UriMap[params.TextDocument.URI] = originalUri
-			trans.Documents[originalUri] = TextDocument{
-				Text: params.TextDocument.Text,
-				URI:  params.TextDocument.URI,
+			doc := TextDocument{
+				Text:       params.TextDocument.Text,
+				URI:        params.TextDocument.URI,
+				LanguageID: params.TextDocument.LanguageID,
+				Version:    params.TextDocument.Version,
 			}
+			_, span := startSpan(context.Context, "isolate", spanInternal)
+			params.TextDocument.Text = doc.Isolate(trans.isolation())
+			span.set("lsportal.inclusions", len(doc.Inclusions))
+			span.end(nil)
+			trans.Documents[originalUri] = doc
+			trans.metrics.documentInclusions(trans.route, originalUri, len(doc.Inclusions))
 			trans.logger.Debugf("Added document: %s", originalUri)
 			return nil
 		})
+	case MethodTextDocumentDidClose:
+		runParamsTransform(context, func(params *DidCloseTextDocumentParams) error {
+			originalUri := params.TextDocument.URI
+			params.TextDocument.URI = trans.changeExtension(originalUri)
+			// A restarted server shouldn't get closed documents back, UriMap stays for late diagnostics
+			delete(trans.Documents, originalUri)
+			trans.metrics.documentInclusions(trans.route, originalUri, -1)
+			return nil
+		})
+	case MethodInlayHintResolve:
+		return trans.unwrapInlayHint(context)
+	case MethodCodeActionResolve:
+		return trans.unwrapCodeAction(context)
+	case MethodTextDocumentRename, MethodTextDocumentPrepareRename:
+		// Renaming from the host code would have the inner server rename something it only saw blanked out
+		var rejected *rejectedError
+		if err := trans.transformDocumentRequest(context); errors.As(err, &rejected) {
+			return reject("Can't rename outside of an inclusion")
+		} else if err != nil {
+			return err
+		}
 	default:
-		runParamsTransform(context, func(params *any) error {
-
-			params2 := (*params).(map[string]interface{})
-			var foundUri string
-			if reqMap, ok := params2["textDocument"].(map[string]interface{}); ok {
-				// reqMap is the object in "request: {...}"
-				if uri, ok := reqMap["uri"].(string); ok {
-					// uri is the URI of the document
-					foundUri = uri
-					reqMap["uri"] = trans.changeExtension(uri)
-				}
+		if _, ok := rangeMethods[context.Method]; ok {
+			if err := trans.clampRangeRequest(context); err != nil {
+				return err
+			}
+			return trans.transformDocumentRequest(context)
+		}
+		trans.transformDocumentRequest(context)
+	}
+	return nil
+}
+
+// Moves a request about a document into its virtual document, it is rejected if its position is outside the inclusions
+func (trans *FromClientTransformer) transformDocumentRequest(context *glsp.Context) error {
+	return runParamsTransform(context, func(params *any) error {
+
+		params2 := (*params).(map[string]interface{})
+		var foundUri string
+		if reqMap, ok := params2["textDocument"].(map[string]interface{}); ok {
+			// reqMap is the object in "request: {...}"
+			if uri, ok := reqMap["uri"].(string); ok {
+				// uri is the URI of the document
+				foundUri = uri
+				reqMap["uri"] = trans.changeExtension(uri)
 			}
-			//check to make sure we are within the inclusion area
-			if foundUri != "" {
-				if position, ok := params2["position"].(map[string]interface{}); ok {
-					if position["line"] != nil && position["character"] != nil {
-						line := uint32(position["line"].(float64))
-						character := uint32(position["character"].(float64))
-						//find if the position is within an inclusion
-						for _, inclusion := range trans.Documents[foundUri].Inclusions {
-							if isInRange(inclusion, Position{Line: line, Character: character}) {
-								return nil
-							}
-						}
+		}
+		//check to make sure we are within the inclusion area
+		if foundUri != "" {
+			if position, ok := params2["position"].(map[string]interface{}); ok {
+				if position["line"] != nil && position["character"] != nil {
+					line := uint32(position["line"].(float64))
+					character := uint32(position["character"].(float64))
+					//find if the position is within an inclusion
+					if !trans.inInclusion(foundUri, Position{Line: line, Character: character}) {
 						trans.logger.Infof("Request from outside of inclusions: %v", trans.Documents[foundUri].Inclusions)
-						return fmt.Errorf("Request from outside of inclusion: %v", trans.Documents[foundUri].Inclusions)
+						return reject("Request from outside of inclusion: %v", trans.Documents[foundUri].Inclusions)
 					}
 				}
 			}
-			return nil
-		})
+		}
+		//move positions into the virtual document
+		*params, _ = trans.toVirtual().walk(params2, trans.sourceMapFor(foundUri))
+		return nil
+	})
+}
 
+// Checks if any open document has an inclusion
+func (trans *FromClientTransformer) hasInclusions() bool {
+	trans.lock.RLock()
+	defer trans.lock.RUnlock()
+	for _, doc := range trans.Documents {
+		if len(doc.Inclusions) > 0 {
+			return true
+		}
 	}
-	return nil
+	return false
+}
+
+// Checks if the position is within one of the document's inclusions, safe to call from outside the transformer
+func (trans *FromClientTransformer) ownsPosition(uri string, pos Position) bool {
+	trans.lock.RLock()
+	defer trans.lock.RUnlock()
+	return trans.inInclusion(uri, pos)
+}
+
+func (trans *FromClientTransformer) inInclusion(uri string, pos Position) bool {
+	for _, inclusion := range trans.Documents[uri].Inclusions {
+		if isInRange(inclusion, pos) {
+			return true
+		}
+	}
+	return false
 }
+
 func isInRange(r Range, pos Position) bool {
 	if pos.Line < r.Start.Line || pos.Line > r.End.Line {
 		return false
@@ -122,32 +235,73 @@ func isInRange(r Range, pos Position) bool {
 }
 
 // Transfrom Responses from the inclusion server so that they are recognizable by the client
-func (trans *FromClientTransformer) TransformResponse(response *any) {
-
-	//Change url back to original
-	switch (*response).(type) {
-	case map[string]interface{}:
-		response2 := (*response).(map[string]interface{})
-		if reqMap, ok := response2["textDocument"].(map[string]interface{}); ok {
-			// reqMap is the object in "request: {...}"
-			if uri, ok := reqMap["uri"].(string); ok {
-				if strings.HasSuffix(uri, trans.Extension) {
-					// uri is the URI of the document
-					reqMap["uri"] = trans.UriMap[uri]
-
-				}
-			}
+func (trans *FromClientTransformer) TransformResponse(context *glsp.Context, response *any) error {
+	trans.lock.RLock()
+	defer trans.lock.RUnlock()
+	switch {
+	case context.Method == MethodInitialize:
+		trans.semanticTokens.translateLegend(*response)
+	case isSemanticTokensMethod(context.Method):
+		trans.transformSemanticTokens(context, response)
+		return nil
+	case context.Method == MethodTextDocumentRename:
+		return trans.confineWorkspaceEdit(*response)
+	case context.Method == MethodTextDocumentCodeAction:
+		trans.transformCodeActions(context, response)
+		return nil
+	case context.Method == MethodCodeActionResolve:
+		if action, ok := trans.transformCodeAction(context, *response); ok {
+			*response = action
+			return nil
 		}
-	default:
-		return
+		return reject("The code action edits outside of the inclusions")
+	case context.Method == MethodTextDocumentDocumentLink:
+		trans.transformDocumentLinks(context, response)
+		return nil
+	case context.Method == MethodTextDocumentColor, context.Method == MethodTextDocumentColorPresentation:
+		trans.transformColors(context, response)
+		return nil
+	case context.Method == MethodTextDocumentFoldingRange:
+		trans.transformFoldingRanges(context, response)
+		return nil
+	case context.Method == MethodTextDocumentDocumentSymbol:
+		trans.transformDocumentSymbols(context, response)
+		return nil
+	case context.Method == MethodTextDocumentInlayHint:
+		trans.transformInlayHints(context, response)
+		return nil
+	case context.Method == MethodInlayHintResolve:
+		if hint, ok := trans.transformInlayHint(trans.UriMap[requestUri(context)], *response); ok {
+			*response = hint
+			return nil
+		}
+		return reject("The inlay hint is outside of the inclusions")
 	}
-
+	//Change uris and positions back to the original
+	sourceMap := trans.toHost().requestSourceMap(context)
+	newResponse, ok := trans.toHost().walkFields(*response, sourceMap)
+	if !ok {
+		//The whole result sits somewhere the client can't see, eg: a definition in an injected prefix
+		*response = nil
+		return nil
+	}
+	*response = newResponse
+	return nil
 }
 
 // unmarshals into your format
-func runParamsTransform[P any](context *glsp.Context, transform func(params *P) error) error {
+func runParamsTransform[P any](context *glsp.Context, transform func(params *P) error) (err error) {
+	ctx := context.Context
+	var span *span
+	context.Context, span = startSpan(ctx, "runParamsTransform", spanInternal)
+	defer func() {
+		context.Context = ctx
+		span.end(err)
+	}()
 	params := new(P)
-	err := json.Unmarshal(context.Params, &params)
+	_, unmarshalSpan := startSpan(context.Context, "unmarshal params", spanInternal)
+	err = json.Unmarshal(context.Params, &params)
+	unmarshalSpan.end(err)
 	if err != nil {
 		return err
 	}
@@ -157,7 +311,9 @@ func runParamsTransform[P any](context *glsp.Context, transform func(params *P)
 		return err
 	}
 
+	_, marshalSpan := startSpan(context.Context, "marshal params", spanInternal)
 	newParams, err := json.Marshal(params)
+	marshalSpan.end(err)
 	if err != nil {
 		return err
 	}
@@ -165,6 +321,32 @@ func runParamsTransform[P any](context *glsp.Context, transform func(params *P)
 	return nil
 }
 
+// The options for building virtual documents
+func (trans *FromClientTransformer) isolation() Isolation {
+	return Isolation{
+		Regex:                 trans.Regex,
+		ExclusionRegex:        trans.ExclusionRegex,
+		Prefix:                trans.Prefix,
+		Suffix:                trans.Suffix,
+		Placeholder:           trans.Placeholder,
+		PlaceholderSameLength: trans.PlaceholderSameLength,
+		Groups:                trans.Groups,
+		SkipGroups:            trans.SkipGroups,
+	}
+}
+
+// Sets the options for building virtual documents
+func (trans *FromClientTransformer) setIsolation(isolation Isolation) {
+	trans.Regex = isolation.Regex
+	trans.ExclusionRegex = isolation.ExclusionRegex
+	trans.Prefix = isolation.Prefix
+	trans.Suffix = isolation.Suffix
+	trans.Placeholder = isolation.Placeholder
+	trans.PlaceholderSameLength = isolation.PlaceholderSameLength
+	trans.Groups = isolation.Groups
+	trans.SkipGroups = isolation.SkipGroups
+}
+
 func (trans *FromClientTransformer) changeExtension(uri URI) string {
 	strs := strings.Split(uri, ".")
 	strs[len(strs)-1] = trans.Extension
@@ -16,6 +16,8 @@ var _ Transformer = &FromInclusionTransformer{}
 
 // Transform requests from the inclusionServer so that the client is happy
 func (trans *FromInclusionTransformer) TransformRequest(context *glsp.Context) error {
+	trans.ServerTransformer.lock.RLock()
+	defer trans.ServerTransformer.lock.RUnlock()
 	switch context.Method {
 	case ServerWorkspaceConfiguration:
 		{
@@ -28,23 +30,20 @@ func (trans *FromInclusionTransformer) TransformRequest(context *glsp.Context) e
 				return nil
 			})
 		}
+	case ServerWorkspaceApplyEdit:
+		return runParamsTransform(context, func(params *map[string]any) error {
+			if err := trans.ServerTransformer.confineWorkspaceEdit((*params)["edit"]); err != nil {
+				// The inner server learns why from the result, the client never sees the edit
+				reason := err.Error()
+				return &rejectedError{reason: reason, result: ApplyWorkspaceEditResponse{Applied: false, FailureReason: &reason}}
+			}
+			return nil
+		})
 	default:
 
 		return runParamsTransform(context, func(params *any) error {
-			switch (*params).(type) {
-			case ([]any):
-				return nil
-			}
-			params2 := (*params).(map[string]interface{})
-			if reqMap, ok := params2["textDocument"].(map[string]interface{}); ok {
-				// reqMap is the object in "request: {...}"
-				if uri, ok := reqMap["uri"].(string); ok {
-					// uri is the URI of the document
-
-					//TODO:this is likely wrong
-					reqMap["uri"] = trans.ServerTransformer.UriMap[uri]
-				}
-			}
+			// Rewrites document uris, eg: publishDiagnostics, and moves any positions back into the host document
+			*params, _ = trans.ServerTransformer.toHost().walk(*params, nil)
 			return nil
 		})
 	}
@@ -52,21 +51,9 @@ func (trans *FromInclusionTransformer) TransformRequest(context *glsp.Context) e
 }
 
 // Transform responses from the client so that the inclusion server is happy
-func (trans *FromInclusionTransformer) TransformResponse(response *any) {
-	//Change url back to original
-	switch (*response).(type) {
-	case ([]any):
-		return
-	}
-	response2 := (*response).(map[string]interface{})
-	if reqMap, ok := response2["textDocument"].(map[string]interface{}); ok {
-		// reqMap is the object in "request: {...}"
-		if uri, ok := reqMap["uri"].(string); ok {
-			// uri is the URI of the document
-			//TODO:This is likely wrong
-			reqMap["uri"] = trans.ServerTransformer.changeExtension(uri)
-
-		}
-	}
-
+func (trans *FromInclusionTransformer) TransformResponse(context *glsp.Context, response *any) error {
+	trans.ServerTransformer.lock.RLock()
+	defer trans.ServerTransformer.lock.RUnlock()
+	*response, _ = trans.ServerTransformer.toVirtual().walk(*response, nil)
+	return nil
 }
@@ -215,7 +215,7 @@ func TestTransformer_TransformResponse(t *testing.T) {
 	})
 
 	// Call the TransformResponse method
-	trans.TransformResponse(&response)
+	trans.TransformResponse(&glsp.Context{}, &response)
 
 	// Assert the transformed response
 	expectedResponse := map[string]interface{}{
@@ -227,3 +227,67 @@ func TestTransformer_TransformResponse(t *testing.T) {
 		t.Errorf("Expected transformed response: %v, but got: %v", expectedResponse, response)
 	}
 }
+
+func TestTransformer_TransformResponseDropsInjectedEdits(t *testing.T) {
+	trans := NewFromClientTransformer(`~([\s\S]*?)~`, "", "sql")
+	trans.Prefix = "SELECT * FROM t "
+
+	open := &glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go", "text": "q(~WHERE x~)"}}`),
+	}
+	trans.TransformRequest(open)
+
+	// The formatting request as it was forwarded to the inclusion server
+	context := &glsp.Context{
+		Method: protocol.MethodTextDocumentFormatting,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.sql"}}`),
+	}
+	var response any
+	json.Unmarshal([]byte(`[
+		{"range": {"start": {"line": 0, "character": 3}, "end": {"line": 0, "character": 9}}, "newText": "select"},
+		{"range": {"start": {"line": 0, "character": 19}, "end": {"line": 0, "character": 24}}, "newText": "where"}
+	]`), &response)
+	trans.TransformResponse(context, &response)
+
+	// The edit to the prefix is dropped and the edit to the inclusion moves back to the host position
+	var expected any
+	json.Unmarshal([]byte(`[
+		{"range": {"start": {"line": 0, "character": 3}, "end": {"line": 0, "character": 8}}, "newText": "where"}
+	]`), &expected)
+	if !reflect.DeepEqual(expected, response) {
+		t.Errorf("Expected transformed response: %v, but got: %v", expected, response)
+	}
+}
+
+func TestTransformer_TransformResponseDropsUnmappableFields(t *testing.T) {
+	trans := NewFromClientTransformer(`~([\s\S]*?)~`, "", "sql")
+	trans.Prefix = "SELECT * FROM t "
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go", "text": "q(~WHERE x~)"}}`),
+	})
+	context := &glsp.Context{
+		Method: protocol.MethodTextDocumentHover,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.sql"}, "position": {"line": 0, "character": 20}}`),
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		expected string
+	}{
+		{"range within the inclusion moves", `{"contents": "where", "range": {"start": {"line": 0, "character": 19}, "end": {"line": 0, "character": 24}}}`, `{"contents":"where","range":{"end":{"character":8,"line":0},"start":{"character":3,"line":0}}}`},
+		{"range over the prefix is dropped, not the hover", `{"contents": "query", "range": {"start": {"line": 0, "character": 3}, "end": {"line": 0, "character": 24}}}`, `{"contents":"query"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response any
+			json.Unmarshal([]byte(test.response), &response)
+			trans.TransformResponse(context, &response)
+			if got, _ := json.Marshal(response); string(got) != test.expected {
+				t.Errorf("Expected: %s, Got: %s", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package lsportal
+
+// Transports for inclusion servers that are already running, eg: daemons listening on a socket.
+// Everything ends up as a stream of Content-Length framed messages so the rest of lsportal doesn't care where the server lives
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+type TransportKind int
+
+const (
+	// Spawn the server and talk to it over stdin and stdout
+	TransportStdio TransportKind = iota
+	TransportTCP
+	TransportUnix
+	TransportWebSocket
+)
+
+// Where to find the inclusion server, the zero value spawns it
+type Transport struct {
+	Kind TransportKind
+	// host:port for TCP, the socket path for Unix and the url for WebSocket
+	Address string
+}
+
+// Parses "tcp:host:port", "unix:/path" and "ws://" or "wss://" urls, anything else is a command to spawn
+func ParseTransport(target string) (Transport, bool) {
+	switch {
+	case strings.HasPrefix(target, "tcp:"):
+		return Transport{Kind: TransportTCP, Address: strings.TrimPrefix(target, "tcp:")}, true
+	case strings.HasPrefix(target, "unix:"):
+		return Transport{Kind: TransportUnix, Address: strings.TrimPrefix(target, "unix:")}, true
+	case strings.HasPrefix(target, "ws://"), strings.HasPrefix(target, "wss://"):
+		return Transport{Kind: TransportWebSocket, Address: target}, true
+	}
+	return Transport{}, false
+}
+
+func (transport Transport) String() string {
+	switch transport.Kind {
+	case TransportTCP:
+		return "tcp:" + transport.Address
+	case TransportUnix:
+		return "unix:" + transport.Address
+	case TransportWebSocket:
+		return transport.Address
+	}
+	return "stdio"
+}
+
+// Connects to a running inclusion server
+func Dial(transport Transport) (io.ReadWriteCloser, error) {
+	switch transport.Kind {
+	case TransportTCP:
+		conn, err := net.Dial("tcp", transport.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &closeOnce{ReadWriteCloser: conn}, nil
+	case TransportUnix:
+		conn, err := net.Dial("unix", transport.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &closeOnce{ReadWriteCloser: conn}, nil
+	case TransportWebSocket:
+		conn, _, err := websocket.DefaultDialer.Dial(transport.Address, nil)
+		if err != nil {
+			return nil, err
+		}
+		return NewWebSocketStream(conn), nil
+	}
+	return nil, fmt.Errorf("can't dial a %s server", transport)
+}
+
+// Listens for clients connecting to lsportal itself, only TCP and Unix sockets are supported
+func Listen(transport Transport) (net.Listener, error) {
+	switch transport.Kind {
+	case TransportTCP:
+		return net.Listen("tcp", transport.Address)
+	case TransportUnix:
+		// A socket left behind by a previous run would make listening fail
+		if info, err := os.Stat(transport.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(transport.Address)
+		}
+		return net.Listen("unix", transport.Address)
+	}
+	return nil, fmt.Errorf("can't listen on %s", transport)
+}
+
+// jsonrpc2 closes the stream when the connection drops and we close it again once we are done with it
+type closeOnce struct {
+	io.ReadWriteCloser
+	once sync.Once
+	err  error
+}
+
+func (self *closeOnce) Close() error {
+	self.once.Do(func() {
+		self.err = self.ReadWriteCloser.Close()
+	})
+	return self.err
+}
+
+// Turns a WebSocket, where every message is one JSON-RPC message, into a Content-Length framed stream
+type webSocketStream struct {
+	conn *websocket.Conn
+	// What's left of the message being read, headers included
+	reading []byte
+	// Framed bytes written that don't make up a whole message yet
+	writeLock sync.Mutex
+	writing   []byte
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func NewWebSocketStream(conn *websocket.Conn) io.ReadWriteCloser {
+	return &webSocketStream{conn: conn}
+}
+
+func (self *webSocketStream) Read(p []byte) (int, error) {
+	if len(self.reading) == 0 {
+		_, message, err := self.conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		self.reading = append([]byte(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(message))), message...)
+	}
+	n := copy(p, self.reading)
+	self.reading = self.reading[n:]
+	return n, nil
+}
+
+func (self *webSocketStream) Write(p []byte) (int, error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	self.writing = append(self.writing, p...)
+	for {
+		headerEnd := bytes.Index(self.writing, []byte("\r\n\r\n"))
+		if headerEnd < 0 {
+			return len(p), nil
+		}
+		length, err := contentLength(self.writing[:headerEnd])
+		if err != nil {
+			return 0, err
+		}
+		bodyStart := headerEnd + 4
+		if len(self.writing) < bodyStart+length {
+			return len(p), nil
+		}
+		if err := self.conn.WriteMessage(websocket.TextMessage, self.writing[bodyStart:bodyStart+length]); err != nil {
+			return 0, err
+		}
+		self.writing = self.writing[bodyStart+length:]
+	}
+}
+
+func (self *webSocketStream) Close() error {
+	self.closeOnce.Do(func() {
+		self.closeErr = self.conn.Close()
+	})
+	return self.closeErr
+}
+
+func contentLength(header []byte) (int, error) {
+	for _, line := range strings.Split(string(header), "\r\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			return strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	return 0, fmt.Errorf("message without a Content-Length header: %q", header)
+}
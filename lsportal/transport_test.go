@@ -0,0 +1,118 @@
+package lsportal
+
+import (
+	contextpkg "context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// Answers initialize on every stream it is given, like a language server daemon would
+func serveFakeServer(streams <-chan io.ReadWriteCloser) {
+	for stream := range streams {
+		jsonrpc2.NewConn(contextpkg.Background(), jsonrpc2.NewBufferedStream(stream, jsonrpc2.VSCodeObjectCodec{}),
+			jsonrpc2.HandlerWithError(func(ctx contextpkg.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (any, error) {
+				return map[string]any{"capabilities": map[string]any{"hoverProvider": true}, "method": req.Method}, nil
+			}))
+	}
+}
+
+func listenFake(t *testing.T, network string, address string) string {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	streams := make(chan io.ReadWriteCloser)
+	go serveFakeServer(streams)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(streams)
+				return
+			}
+			streams <- conn
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func listenFakeWebSocket(t *testing.T) string {
+	streams := make(chan io.ReadWriteCloser)
+	go serveFakeServer(streams)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		streams <- NewWebSocketStream(conn)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestDial(t *testing.T) {
+	tests := []struct {
+		name   string
+		target func(t *testing.T) string
+	}{
+		{"tcp", func(t *testing.T) string { return "tcp:" + listenFake(t, "tcp", "127.0.0.1:0") }},
+		{"unix", func(t *testing.T) string {
+			return "unix:" + listenFake(t, "unix", filepath.Join(t.TempDir(), "server.sock"))
+		}},
+		{"websocket", listenFakeWebSocket},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport, ok := ParseTransport(test.target(t))
+			if !ok {
+				t.Fatalf("Expected a transport")
+			}
+			stream, err := Dial(transport)
+			if err != nil {
+				t.Fatalf("Failed to dial %s: %v", transport, err)
+			}
+			conn := jsonrpc2.NewConn(contextpkg.Background(), jsonrpc2.NewBufferedStream(stream, jsonrpc2.VSCodeObjectCodec{}), nil)
+			defer conn.Close()
+
+			ctx, cancel := contextpkg.WithTimeout(contextpkg.Background(), 5*time.Second)
+			defer cancel()
+			var result map[string]any
+			if err := conn.Call(ctx, "initialize", map[string]any{"processId": nil}, &result); err != nil {
+				t.Fatalf("Failed to call initialize: %v", err)
+			}
+			if result["method"] != "initialize" {
+				t.Errorf("Expected the fake server to answer initialize, Got: %v", result)
+			}
+		})
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected Transport
+		ok       bool
+	}{
+		{"tcp:127.0.0.1:2087", Transport{Kind: TransportTCP, Address: "127.0.0.1:2087"}, true},
+		{"unix:/tmp/ls.sock", Transport{Kind: TransportUnix, Address: "/tmp/ls.sock"}, true},
+		{"ws://localhost:3000/lsp", Transport{Kind: TransportWebSocket, Address: "ws://localhost:3000/lsp"}, true},
+		{"vscode-html-language-server", Transport{}, false},
+	}
+	for _, test := range tests {
+		transport, ok := ParseTransport(test.target)
+		if ok != test.ok || transport != test.expected {
+			t.Errorf("%s: Expected: %v %v, Got: %v %v", test.target, test.expected, test.ok, transport, ok)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package lsportal
+
+// A WorkspaceEdit from the inner server, eg: the result of a rename, can reach anywhere in the virtual documents, even
+// into other files the inner server happens to know. Every edit has to map back onto a document the client opened and
+// stay within one of its inclusions, otherwise the whole edit is rejected: applying only part of a rename would leave
+// the code broken.
+// Creating, renaming and deleting real files is left to the client, but not the virtual documents: they stand for the
+// host files.
+
+import (
+	"fmt"
+)
+
+// A request or edit we refuse, the reason is passed on to the sender
+type rejectedError struct {
+	reason string
+	// Answers the request instead of the error if set, for requests that report failures in their result
+	result any
+}
+
+func (err *rejectedError) Error() string {
+	return err.reason
+}
+
+func reject(format string, args ...any) error {
+	return &rejectedError{reason: fmt.Sprintf(format, args...)}
+}
+
+// Moves the WorkspaceEdit into the host documents in place, call with the lock held
+func (trans *FromClientTransformer) confineWorkspaceEdit(edit any) error {
+	object, ok := edit.(map[string]any)
+	if !ok {
+		// null, nothing to edit
+		return nil
+	}
+	if changes, ok := object["changes"].(map[string]any); ok {
+		hostChanges := make(map[string]any, len(changes))
+		for uri, edits := range changes {
+			hostUri, err := trans.confineTextEdits(uri, edits)
+			if err != nil {
+				return err
+			}
+			hostChanges[hostUri] = edits
+		}
+		object["changes"] = hostChanges
+	}
+	if documentChanges, ok := object["documentChanges"].([]any); ok {
+		// Files the edit creates are the client's, it may edit them too
+		created := map[string]bool{}
+		for _, change := range documentChanges {
+			change, _ := change.(map[string]any)
+			if kind, ok := change["kind"].(string); ok {
+				if err := trans.checkResourceOperation(kind, change); err != nil {
+					return err
+				}
+				if uri, ok := change["uri"].(string); ok && kind == "create" {
+					created[uri] = true
+				}
+				if uri, ok := change["newUri"].(string); ok {
+					created[uri] = true
+				}
+				continue
+			}
+			textDocument, _ := change["textDocument"].(map[string]any)
+			uri, _ := textDocument["uri"].(string)
+			if created[uri] {
+				continue
+			}
+			hostUri, err := trans.confineTextEdits(uri, change["edits"])
+			if err != nil {
+				return err
+			}
+			// The virtual document has the version of its host
+			textDocument["uri"] = hostUri
+		}
+	}
+	return nil
+}
+
+// Checks that a create, rename or delete doesn't touch a virtual document
+func (trans *FromClientTransformer) checkResourceOperation(kind string, operation map[string]any) error {
+	for _, key := range []string{"uri", "oldUri", "newUri"} {
+		uri, _ := operation[key].(string)
+		if hostUri, ok := trans.UriMap[uri]; ok {
+			return reject("Can't %s %s, it is the inclusions of %s", kind, uri, hostUri)
+		}
+	}
+	return nil
+}
+
+// Moves the TextEdits of a virtual document into its host document, returning the uri of the host
+func (trans *FromClientTransformer) confineTextEdits(uri string, edits any) (string, error) {
+	hostUri, ok := trans.UriMap[uri]
+	if !ok {
+		return "", reject("Can't edit %s, it isn't the inclusions of an open document", uri)
+	}
+	doc, ok := trans.Documents[hostUri]
+	if !ok {
+		return "", reject("Can't edit %s, it was closed", hostUri)
+	}
+	items, _ := edits.([]any)
+	for _, item := range items {
+		edit, _ := item.(map[string]any)
+		r, ok := asRange(edit["range"])
+		if !ok {
+			return "", reject("Can't apply an edit of %s without a range", hostUri)
+		}
+		hostRange, ok := doc.SourceMap.RangeToHost(r)
+		if !ok || !doc.SourceMap.EditableInVirtual(r) || doc.inclusionOf(hostRange) < 0 {
+			return "", reject("Can't edit %s on line %d, it is outside of the inclusions", hostUri, hostRange.Start.Line+1)
+		}
+		edit["range"] = hostRange
+	}
+	return hostUri, nil
+}
@@ -0,0 +1,142 @@
+package lsportal
+
+import (
+	contextpkg "context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/tliron/glsp"
+	protocol "github.com/tliron/glsp/protocol_3_16"
+)
+
+func TestConfineWorkspaceEdit(t *testing.T) {
+	trans := NewFromClientTransformer("htmlT\\(`([\\s\\S]*?)`\\)", "", "html")
+	trans.Prefix = "<p>"
+	trans.TransformRequest(&glsp.Context{
+		Method: protocol.MethodTextDocumentDidOpen,
+		Params: []byte(`{"textDocument": {"uri": "file:///a.go", "languageId": "go", "version": 3, "text": "x := 1\na := htmlT(` + "`" + `<b id=\"x\">` + "`" + `)"}}`),
+	})
+	edit := func(startChar, endChar int) string {
+		return fmt.Sprintf(`{"range": {"start": {"line": 1, "character": %d}, "end": {"line": 1, "character": %d}}, "newText": "y"}`, startChar, endChar)
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		expected string
+		err      string
+	}{
+		{
+			name:     "changes move to the host",
+			response: `{"changes": {"file:///a.html": [` + edit(22, 23) + `]}}`,
+			expected: `{"changes":{"file:///a.go":[{"newText":"y","range":{"start":{"line":1,"character":19},"end":{"line":1,"character":20}}}]}}`,
+		},
+		{
+			name:     "document changes move to the host",
+			response: `{"documentChanges": [{"textDocument": {"uri": "file:///a.html", "version": 3}, "edits": [` + edit(22, 23) + `]}]}`,
+			expected: `{"documentChanges":[{"edits":[{"newText":"y","range":{"start":{"line":1,"character":19},"end":{"line":1,"character":20}}}],"textDocument":{"uri":"file:///a.go","version":3}}]}`,
+		},
+		{
+			name:     "edits of other files are rejected",
+			response: `{"changes": {"file:///b.html": [` + edit(0, 1) + `]}}`,
+			err:      "Can't edit file:///b.html, it isn't the inclusions of an open document",
+		},
+		{
+			name:     "edits of the injected prefix are rejected",
+			response: `{"changes": {"file:///a.html": [` + edit(12, 16) + `]}}`,
+			err:      "Can't edit file:///a.go on line 2, it is outside of the inclusions",
+		},
+		{
+			name:     "virtual documents can't be renamed",
+			response: `{"documentChanges": [{"kind": "rename", "oldUri": "file:///a.html", "newUri": "file:///b.html"}]}`,
+			err:      "Can't rename file:///a.html, it is the inclusions of file:///a.go",
+		},
+		{
+			name:     "created files are left to the client",
+			response: `{"documentChanges": [{"kind": "create", "uri": "file:///c.html"}, {"textDocument": {"uri": "file:///c.html", "version": null}, "edits": [` + edit(0, 0) + `]}]}`,
+			expected: `{"documentChanges":[{"kind":"create","uri":"file:///c.html"},{"edits":[{"newText":"y","range":{"end":{"character":0,"line":1},"start":{"character":0,"line":1}}}],"textDocument":{"uri":"file:///c.html","version":null}}]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response any
+			json.Unmarshal([]byte(test.response), &response)
+			err := trans.TransformResponse(&glsp.Context{
+				Method: protocol.MethodTextDocumentRename,
+				Params: []byte(`{"textDocument": {"uri": "file:///a.html"}, "position": {"line": 1, "character": 22}, "newName": "y"}`),
+			}, &response)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("Expected error: %s, Got: %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to confine the edit: %v", err)
+			}
+			if got, _ := json.Marshal(response); string(got) != test.expected {
+				t.Errorf("Expected: %s, Got: %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRenameOutsideInclusion(t *testing.T) {
+	fromClient, _, _ := InitRoutes(false, []Route{{Isolation: Isolation{Regex: "htmlT\\(`([\\s\\S]*?)`\\)"}, Extension: "html"}})
+	open, _ := json.Marshal(protocol.DidOpenTextDocumentParams{TextDocument: protocol.TextDocumentItem{URI: "file:///a.go", LanguageID: "go", Version: 1, Text: "x := htmlT(`<b>`)"}})
+	fromClient.Handler.Handle(&glsp.Context{Method: protocol.MethodTextDocumentDidOpen, Params: open, Notification: true, Context: contextpkg.Background()})
+	for _, method := range []string{protocol.MethodTextDocumentPrepareRename, protocol.MethodTextDocumentRename} {
+		_, _, _, err := fromClient.Handler.Handle(&glsp.Context{
+			Method:  method,
+			Params:  []byte(`{"textDocument": {"uri": "file:///a.go"}, "position": {"line": 0, "character": 0}, "newName": "y"}`),
+			Context: contextpkg.Background(),
+		})
+		if err == nil || err.Error() != "Can't rename outside of an inclusion" {
+			t.Errorf("Expected %s outside of the inclusions to be rejected, Got: %v", method, err)
+		}
+	}
+}
+
+func TestApplyEdit(t *testing.T) {
+	fromClient, _, server := serveRoute(t, Route{Isolation: Isolation{Regex: `~([\s\S]*?)~`}, Extension: "html"})
+	client := connectClient(t, fromClient)
+	client.Handle(protocol.ServerWorkspaceApplyEdit, func(json.RawMessage) (any, error) {
+		return protocol.ApplyWorkspaceEditResponse{Applied: true}, nil
+	})
+	client.Initialize("file:///project")
+	client.DidOpen("file:///project/a.go", "go", "x := 1\ny := ~<p>~")
+	if _, err := server.WaitForOpen(); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	applyEdit := func(line, startChar, endChar int) (protocol.ApplyWorkspaceEditResponse, error) {
+		var result protocol.ApplyWorkspaceEditResponse
+		edit := fmt.Sprintf(`{"range": {"start": {"line": %d, "character": %d}, "end": {"line": %d, "character": %d}}, "newText": "b"}`, line, startChar, line, endChar)
+		err := server.Call(protocol.ServerWorkspaceApplyEdit, json.RawMessage(`{"edit": {"changes": {"file:///project/a.html": [`+edit+`]}}}`), &result)
+		return result, err
+	}
+
+	if result, err := applyEdit(1, 7, 8); err != nil || !result.Applied {
+		t.Fatalf("Expected the edit to be applied, Got: %v, %v", result, err)
+	}
+	message, err := client.WaitFor(protocol.ServerWorkspaceApplyEdit)
+	var params protocol.ApplyWorkspaceEditParams
+	if err != nil || message.Decode(&params) != nil || len(params.Edit.Changes["file:///project/a.go"]) != 1 {
+		t.Errorf("Expected the client to get the edit of the host document, Got: %s, %v", message.Params, err)
+	}
+
+	result, err := applyEdit(0, 0, 1)
+	if err != nil || result.Applied || result.FailureReason == nil || *result.FailureReason != "Can't edit file:///project/a.go on line 1, it is outside of the inclusions" {
+		t.Errorf("Expected the edit outside of the inclusion to fail, Got: %v, %v", result, err)
+	}
+	// The inner server got its answer, so the edit would have reached the client already
+	edits := 0
+	for _, message := range client.Received() {
+		if message.Method == protocol.ServerWorkspaceApplyEdit {
+			edits++
+		}
+	}
+	if edits != 1 {
+		t.Errorf("Expected the client not to get the edit outside of the inclusion, Got: %d edits", edits)
+	}
+}
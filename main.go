@@ -3,73 +3,308 @@ package main
 import (
 	"fmt"
 	"main/lsportal"
+	"net"
+	"net/http"
+	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/tliron/commonlog"
 	_ "github.com/tliron/commonlog/simple"
+	"github.com/tliron/glsp/server"
 )
 
 type Config struct {
 	regex          string
 	exclusionRegex string
+	prefix         string
+	suffix         string
+	placeholder    string
+	sameLength     bool
 	extension      string
 	lsCmd          string
 	lsArgs         []string
+	// Extra servers for named capture groups, as "group=cmd args..."
+	servers       []string
+	maxRestarts   int
+	forwardStderr bool
+	shutdownGrace time.Duration
+	// Start the language servers once a document with an inclusion is open, stopping them when idle
+	lazy         bool
+	idleShutdown time.Duration
+	// The language servers' working directory, extra environment and PATH entries
+	dir  string
+	env  []string
+	path []string
+	// Serve clients on a socket instead of stdio
+	listen       string
+	shareServers bool
+	// JSONL file recording every message at every hop, starting with the setup when recording a session to replay
+	trace  string
+	record bool
+	// Serve metrics on this address and/or write them to this file on exit
+	metrics     string
+	metricsFile string
+	// OTLP/JSON spans go to this file or collector url
+	otlp string
+	// Nest document symbols under a symbol for each inclusion
+	groupSymbols bool
+	// Add a folding range for each multi-line inclusion
+	foldInclusions bool
 	debug          bool
 }
 
+// An inclusion server and the route that feeds it
+type routedServer struct {
+	route lsportal.Route
+	cmd   string
+	args  []string
+}
+
 var config Config
 
+// Set with --trace
+var tracer *lsportal.Tracer
+
+// Set with --metrics or --metrics-file
+var metrics *lsportal.Metrics
+
+// Set with --otlp
+var spans *lsportal.SpanExporter
+
 var rootCmd = &cobra.Command{
 	Use:   "lsportal <extension> <regex> <cmd> [-- lsArgs...]",
 	Short: "LSPortal is a language server portal",
 	Args:  cobra.MinimumNArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
-		config.extension = args[0]
-		config.regex = args[1]
-		config.lsCmd = args[2]
-		// Find the index of "--" separator
+		run(args, cmd.ArgsLenAtDash())
+	},
+}
+
+var recordCmd = &cobra.Command{
+	Use:   "record <file> <extension> <regex> <cmd> [-- lsArgs...]",
+	Short: "Run as usual while recording the session to a file that can be replayed in tests",
+	Args:  cobra.MinimumNArgs(4),
+	Run: func(cmd *cobra.Command, args []string) {
+		config.trace = args[0]
+		config.record = true
 		sepIndex := cmd.ArgsLenAtDash()
 		if sepIndex != -1 {
-			config.lsArgs = args[sepIndex:]
+			sepIndex--
 		}
+		run(args[1:], sepIndex)
+	},
+}
 
-		if config.debug {
-			commonlog.Initialize(3, "./lsportalLog.log")
-		}
+// sepIndex is the index of the "--" separator in args, -1 if there is none
+func run(args []string, sepIndex int) {
+	config.extension = args[0]
+	config.regex = args[1]
+	config.lsCmd = args[2]
+	// Find the index of "--" separator
+	if sepIndex != -1 {
+		config.lsArgs = args[sepIndex:]
+	}
 
-		err := validateInputs(&config)
+	if config.debug {
+		commonlog.Initialize(3, "./lsportalLog.log")
+	}
+
+	err := validateInputs(&config)
+	if err != nil {
+		panic(err)
+	}
+
+	isolation := lsportal.Isolation{
+		Regex:                 config.regex,
+		ExclusionRegex:        config.exclusionRegex,
+		Prefix:                config.prefix,
+		Suffix:                config.suffix,
+		Placeholder:           config.placeholder,
+		PlaceholderSameLength: config.sameLength,
+	}
+	servers := []routedServer{{route: lsportal.Route{Isolation: isolation, Extension: config.extension}, cmd: config.lsCmd, args: config.lsArgs}}
+	for _, server := range config.servers {
+		servers = append(servers, parseServer(server, isolation))
+	}
+	var routes []lsportal.Route
+	for i := range servers {
+		servers[i].route.GroupSymbols = config.groupSymbols
+		servers[i].route.FoldInclusions = config.foldInclusions
+		routes = append(routes, servers[i].route)
+	}
+	if config.trace != "" {
+		tracer, err = lsportal.OpenTrace(config.trace)
 		if err != nil {
 			panic(err)
 		}
-
-		fromClient, fromInclusion := lsportal.InitForwarders(config.debug, config.regex, config.exclusionRegex, config.extension)
-
-		readWrite, err := lsportal.StartLanguageServer(config.lsCmd, config.lsArgs)
+		if config.record {
+			tracer.RecordSetup(routes)
+		}
+	}
+	if config.otlp != "" {
+		spans, err = lsportal.OpenSpanExporter(config.otlp)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if config.metrics != "" || config.metricsFile != "" {
+		metrics = lsportal.NewMetrics()
+	}
+	if config.metrics != "" {
+		listener, err := net.Listen("tcp", config.metrics)
 		if err != nil {
-			panic(fmt.Errorf("error starting language server: %v", err))
+			panic(err)
 		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go http.Serve(listener, mux)
+	}
+	if config.listen != "" {
+		exit(listen(servers, routes))
+	}
+	fromClient, lifecycle := startSession(servers, routes)
+	lsportal.ServeStream(fromClient, lsportal.Stdio)
+	// The client sent exit or went away, take the servers down with us
+	exit(lifecycle.Wait())
+}
+
+// Flushes the trace, spans and metrics before exiting
+func exit(code int) {
+	tracer.Close()
+	spans.Close()
+	if config.metricsFile != "" {
+		if err := metrics.WriteFile(config.metricsFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	os.Exit(code)
+}
+
+// Connects a client to its own set of inclusion servers
+func startSession(servers []routedServer, routes []lsportal.Route) (*server.Server, *lsportal.Lifecycle) {
+	fromClient, inclusions, lifecycle := lsportal.InitRoutes(config.debug, routes)
+	lifecycle.GracePeriod = config.shutdownGrace
+	startSupervisors(fromClient, inclusions, servers)
+	return fromClient, lifecycle
+}
 
-		var wg sync.WaitGroup
-		wg.Add(2)
+func startSupervisors(fromClient *server.Server, inclusions []*lsportal.Inclusion, servers []routedServer) {
+	for i, server := range servers {
+		inclusions[i].Trace(tracer)
+		inclusions[i].Measure(metrics)
+		inclusions[i].ExportSpans(spans)
+		supervisor := lsportal.NewSupervisor(fromClient, inclusions[i], server.cmd, server.args)
+		if transport, ok := lsportal.ParseTransport(server.cmd); ok {
+			supervisor.Transport = transport
+		}
+		supervisor.MaxRestarts = config.maxRestarts
+		supervisor.ForwardStderr = config.forwardStderr
+		supervisor.Lazy = config.lazy
+		supervisor.IdleTimeout = config.idleShutdown
+		supervisor.Dir = config.dir
+		supervisor.Env = config.env
+		supervisor.PathPrepend = config.path
 		go func() {
-			defer wg.Done()
-			fromClient.RunStdio()
+			if err := supervisor.Run(); err != nil {
+				commonlog.GetLogger("lsportal").Errorf("%v", err)
+			}
 		}()
+	}
+}
+
+// Serves every client that connects on --listen until we are interrupted
+func listen(servers []routedServer, routes []lsportal.Route) int {
+	logger := commonlog.GetLogger("lsportal")
+	transport, _ := lsportal.ParseTransport(config.listen)
+	listener, err := lsportal.Listen(transport)
+	if err != nil {
+		logger.Errorf("error listening on %s: %v", transport, err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	logger.Infof("listening on %s", transport)
+
+	var lock sync.Mutex
+	lifecycles := map[*lsportal.Lifecycle]bool{}
+	var shared *lsportal.SharedSession
+	if config.shareServers {
+		var inclusions []*lsportal.Inclusion
+		var lifecycle *lsportal.Lifecycle
+		shared, inclusions, lifecycle = lsportal.InitSharedRoutes(config.debug, routes)
+		lifecycle.GracePeriod = config.shutdownGrace
+		lifecycles[lifecycle] = true
+		startSupervisors(nil, inclusions, servers)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		if shared != nil {
+			go shared.Serve(conn)
+			continue
+		}
 		go func() {
-			defer wg.Done()
-			fromInclusion.ServeStream(readWrite, commonlog.GetLogger("fromInclusion"))
+			fromClient, lifecycle := startSession(servers, routes)
+			lock.Lock()
+			lifecycles[lifecycle] = true
+			lock.Unlock()
+			lsportal.ServeStream(fromClient, conn)
+			lifecycle.Wait()
+			lock.Lock()
+			delete(lifecycles, lifecycle)
+			lock.Unlock()
 		}()
-		wg.Wait()
-	},
+	}
+
+	// Take down the servers of the clients that are still connected
+	lock.Lock()
+	defer lock.Unlock()
+	for lifecycle := range lifecycles {
+		lifecycle.Wait()
+	}
+	return 0
 }
 
 func init() {
-	rootCmd.Flags().StringVar(&config.exclusionRegex, "exclusion", `;([\s\S]*);`, "Regular expression for exclusion")
-	rootCmd.Flags().BoolVar(&config.debug, "debug", false, "enable debugg logging")
+	rootCmd.PersistentFlags().StringVar(&config.exclusionRegex, "exclusion", `;([\s\S]*);`, "Regular expression for exclusion")
+	rootCmd.PersistentFlags().StringVar(&config.prefix, "prefix", "", "Text injected before every inclusion so partial snippets parse, eg: 'SELECT * FROM t '")
+	rootCmd.PersistentFlags().StringVar(&config.suffix, "suffix", "", "Text injected after every inclusion so partial snippets parse")
+	rootCmd.PersistentFlags().StringVar(&config.placeholder, "placeholder", "", "Token that replaces exclusions instead of whitespace, eg: '__X__'")
+	rootCmd.PersistentFlags().BoolVar(&config.sameLength, "placeholder-same-length", false, "Repeat the placeholder to the length of each exclusion so positions after it don't move")
+	rootCmd.PersistentFlags().StringArrayVar(&config.servers, "server", nil, "Send the named capture group to another server, eg: 'css=vscode-css-language-server --stdio'. The group name is used as the file extension")
+	rootCmd.PersistentFlags().IntVar(&config.maxRestarts, "max-restarts", 5, "How many times in a row to restart a crashing language server before giving up")
+	rootCmd.PersistentFlags().BoolVar(&config.forwardStderr, "forward-stderr", false, "Send everything the language servers write to stderr to the editor as log messages")
+	rootCmd.PersistentFlags().DurationVar(&config.shutdownGrace, "shutdown-grace", 5*time.Second, "How long the language servers get to exit after the editor does before they are killed")
+	rootCmd.PersistentFlags().BoolVar(&config.lazy, "lazy", false, "Only start the language servers once a document with an inclusion is opened")
+	rootCmd.PersistentFlags().DurationVar(&config.idleShutdown, "idle-shutdown", 0, "With --lazy, stop the language servers after this long without any inclusions open, eg: 10m")
+	rootCmd.PersistentFlags().StringVar(&config.dir, "cwd", "", "Working directory for the language servers, defaults to the workspace root the editor opens")
+	rootCmd.PersistentFlags().StringArrayVar(&config.env, "env", nil, "Set an environment variable for the language servers, eg: 'NODE_OPTIONS=--max-old-space-size=4096'")
+	rootCmd.PersistentFlags().StringArrayVar(&config.path, "path", []string{"node_modules/.bin"}, "Directory put in front of the language servers' PATH, relative to their working directory")
+	rootCmd.PersistentFlags().StringVar(&config.listen, "listen", "", "Serve clients connecting on 'tcp:127.0.0.1:port' or 'unix:/path' instead of stdio, each client gets its own language servers")
+	rootCmd.PersistentFlags().BoolVar(&config.shareServers, "share-servers", false, "With --listen, share one set of language servers between every client")
+	rootCmd.PersistentFlags().StringVar(&config.trace, "trace", "", "Write every message to this JSONL file, once for every hop it makes through lsportal")
+	rootCmd.PersistentFlags().StringVar(&config.metrics, "metrics", "", "Serve Prometheus metrics on this address at /metrics, eg: '127.0.0.1:9464'")
+	rootCmd.PersistentFlags().StringVar(&config.metricsFile, "metrics-file", "", "Write the metrics to this file on exit")
+	rootCmd.PersistentFlags().StringVar(&config.otlp, "otlp", "", "Export OpenTelemetry spans as OTLP/JSON to this file, or to a collector at an http(s):// url, eg: 'http://localhost:4318'")
+	rootCmd.PersistentFlags().BoolVar(&config.groupSymbols, "group-symbols", false, "Nest the document symbols of every inclusion under a symbol named after the call around it, eg: 'htmlT @ line 27'")
+	rootCmd.PersistentFlags().BoolVar(&config.foldInclusions, "fold-inclusions", false, "Add a folding range for every inclusion spanning several lines")
+	rootCmd.PersistentFlags().BoolVar(&config.debug, "debug", false, "enable debugg logging")
+	rootCmd.AddCommand(recordCmd)
 }
 
 func main() {
@@ -82,15 +317,65 @@ func main() {
 func validateInputs(config *Config) error {
 
 	// Validate regex
-	if _, err := regexp.Compile(config.regex); err != nil {
+	regex, err := regexp.Compile(config.regex)
+	if err != nil {
 		return fmt.Errorf("Invalid regex: %v\n", err)
 
 	}
 
 	// Validate cmd
-	if _, err := exec.LookPath(config.lsCmd); err != nil {
-		return fmt.Errorf("Command not found: %v\n", err)
+	if err := validateCommand(config.lsCmd); err != nil {
+		return err
+	}
+	if config.listen != "" {
+		transport, ok := lsportal.ParseTransport(config.listen)
+		if !ok || (transport.Kind != lsportal.TransportTCP && transport.Kind != lsportal.TransportUnix) {
+			return fmt.Errorf("Invalid listen address %q, expected tcp:host:port or unix:/path\n", config.listen)
+		}
+	}
+	for _, entry := range config.env {
+		if key, _, ok := strings.Cut(entry, "="); !ok || key == "" {
+			return fmt.Errorf("Invalid env %q, expected KEY=VALUE\n", entry)
+		}
+	}
+	for _, server := range config.servers {
+		name, command, ok := strings.Cut(server, "=")
+		if !ok || name == "" || len(strings.Fields(command)) == 0 {
+			return fmt.Errorf("Invalid server %q, expected group=cmd args...\n", server)
+		}
+		// A server for a group the regex doesn't have would never get an inclusion
+		if regex.SubexpIndex(name) < 0 {
+			return fmt.Errorf("Invalid server %q, the regex has no group named %q\n", server, name)
+		}
+		if err := validateCommand(strings.Fields(command)[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// The command has to exist unless it is the address of a running server
+func validateCommand(command string) error {
+	if _, ok := lsportal.ParseTransport(command); ok {
+		return nil
+	}
+	if _, err := exec.LookPath(command); err != nil {
+		// The servers look in the --path directories first, relative ones are relative to --cwd or else ours
+		if (lsportal.ProcessOptions{Dir: config.dir, PathPrepend: config.path}).Resolve(command) != command {
+			return nil
+		}
+		return fmt.Errorf("Command not found: %v\n", err)
 	}
 	return nil
 }
+
+// Parses a validated --server flag
+func parseServer(server string, isolation lsportal.Isolation) routedServer {
+	name, command, _ := strings.Cut(server, "=")
+	fields := strings.Fields(command)
+	return routedServer{
+		route: lsportal.Route{Name: name, Isolation: isolation, Extension: name},
+		cmd:   fields[0],
+		args:  fields[1:],
+	}
+}